@@ -0,0 +1,86 @@
+package block
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Markers delimit the managed block of a file, each is a line of its own
+type Markers struct {
+	Begin string `yaml:"begin"`
+	End   string `yaml:"end"`
+}
+
+// DefaultMarkers are html comments for markdown and html files, # comments
+// for the others
+func DefaultMarkers(filePath string) Markers {
+	switch strings.ToLower(path.Ext(filePath)) {
+	case ".md", ".markdown", ".html", ".xml":
+		return Markers{
+			Begin: "<!-- BEGIN gitlab-vault managed block, do not edit -->",
+			End:   "<!-- END gitlab-vault managed block -->",
+		}
+	}
+	return Markers{
+		Begin: "# BEGIN gitlab-vault managed block, do not edit",
+		End:   "# END gitlab-vault managed block",
+	}
+}
+
+// Apply replaces the lines between the markers of current with content, or
+// appends the block when current has no markers. Everything outside the
+// block is kept byte for byte.
+func Apply(current, content string, m Markers) (string, error) {
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	begins := markerLines(current, m.Begin)
+	ends := markerLines(current, m.End)
+	switch {
+	case len(begins) == 0 && len(ends) == 0:
+		var sb strings.Builder
+		sb.WriteString(current)
+		if current != "" {
+			if !strings.HasSuffix(current, "\n") {
+				sb.WriteString("\n")
+			}
+			sb.WriteString("\n")
+		}
+		sb.WriteString(m.Begin + "\n" + content + m.End + "\n")
+		return sb.String(), nil
+	case len(begins) != 1 || len(ends) != 1:
+		return "", fmt.Errorf("want one %q and one %q line, found %d and %d", m.Begin, m.End, len(begins), len(ends))
+	}
+
+	begin, end := begins[0], ends[0]
+	if end.start < begin.end {
+		return "", fmt.Errorf("%q comes before %q", m.End, m.Begin)
+	}
+	return current[:begin.end] + content + current[end.start:], nil
+}
+
+// line is a line of a file, end is past its newline
+type line struct {
+	start, end int
+}
+
+// markerLines returns the lines that are the marker, leading and trailing
+// spaces aside
+func markerLines(s, marker string) []line {
+	lines := []line{}
+	for start := 0; start < len(s); {
+		end := strings.IndexByte(s[start:], '\n')
+		if end < 0 {
+			end = len(s)
+		} else {
+			end += start + 1
+		}
+		if strings.TrimSpace(s[start:end]) == marker {
+			lines = append(lines, line{start: start, end: end})
+		}
+		start = end
+	}
+	return lines
+}
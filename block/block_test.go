@@ -0,0 +1,90 @@
+package block
+
+import "testing"
+
+var hash = Markers{Begin: "# BEGIN managed", End: "# END managed"}
+
+func TestApply(t *testing.T) {
+	tests := map[string]struct {
+		current, content, want string
+	}{
+		"replace": {
+			current: "team: a\r\n  # BEGIN managed\nold: 1\nold: 2\n  # END managed\nteam: b",
+			content: "new: 1\n",
+			want:    "team: a\r\n  # BEGIN managed\nnew: 1\n  # END managed\nteam: b",
+		},
+		"replace empty block": {
+			current: "# BEGIN managed\n# END managed\n",
+			content: "new: 1",
+			want:    "# BEGIN managed\nnew: 1\n# END managed\n",
+		},
+		"empty content": {
+			current: "a\n# BEGIN managed\nold\n# END managed\nb\n",
+			content: "",
+			want:    "a\n# BEGIN managed\n# END managed\nb\n",
+		},
+		"append": {
+			current: "team: a\n",
+			content: "new: 1\n",
+			want:    "team: a\n\n# BEGIN managed\nnew: 1\n# END managed\n",
+		},
+		"append without newline": {
+			current: "team: a",
+			content: "new: 1",
+			want:    "team: a\n\n# BEGIN managed\nnew: 1\n# END managed\n",
+		},
+		"missing file": {
+			current: "",
+			content: "new: 1\n",
+			want:    "# BEGIN managed\nnew: 1\n# END managed\n",
+		},
+		"marker inside a line": {
+			current: "echo '# BEGIN managed'\n",
+			content: "new: 1\n",
+			want:    "echo '# BEGIN managed'\n\n# BEGIN managed\nnew: 1\n# END managed\n",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Apply(tt.current, tt.content, hash)
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+			// applying it again changes nothing
+			if again, err := Apply(got, tt.content, hash); err != nil || again != got {
+				t.Errorf("Expected a second Apply to keep %q, got %q, %v", got, again, err)
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	for name, current := range map[string]string{
+		"two begins": "# BEGIN managed\n# BEGIN managed\n# END managed\n",
+		"no end":     "# BEGIN managed\nx\n",
+		"no begin":   "x\n# END managed\n",
+		"reversed":   "# END managed\nx\n# BEGIN managed\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Apply(current, "x\n", hash); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestDefaultMarkers(t *testing.T) {
+	for path, want := range map[string]string{
+		"README.md":       "<!-- BEGIN gitlab-vault managed block, do not edit -->",
+		"docs/index.HTML": "<!-- BEGIN gitlab-vault managed block, do not edit -->",
+		".gitignore":      "# BEGIN gitlab-vault managed block, do not edit",
+		"ci/pipeline.yml": "# BEGIN gitlab-vault managed block, do not edit",
+	} {
+		if got := DefaultMarkers(path).Begin; got != want {
+			t.Errorf("Expected %q for %s, got %q", want, path, got)
+		}
+	}
+}
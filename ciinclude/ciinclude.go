@@ -0,0 +1,403 @@
+package ciinclude
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Merge makes sure the include entries of managed, a CI file with only an
+// include key, are in the CI file current. Entries are matched by their
+// local, remote, template or component, and by project and a shared file,
+// the keys of the managed entry are set on the matching one and the missing
+// entries are appended. Only the include key is rewritten, the jobs, anchors and
+// comments around it are kept as is, and current is returned unchanged when
+// it already has the entries. The added lines end like the lines of
+// current, \r\n or \n.
+func Merge(current, managed string) (string, error) {
+	want, err := managedEntries(managed)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(current) == "" {
+		return managed, nil
+	}
+	eol := lineEnding(current)
+	managed = withLineEnding(managed, eol)
+
+	var doc yaml.Node
+	dec := yaml.NewDecoder(strings.NewReader(current))
+	if err := dec.Decode(&doc); errors.Is(err, io.EOF) {
+		// only comments
+		return appendBlock(current, managed, eol), nil
+	} else if err != nil {
+		return "", fmt.Errorf("invalid CI file: %v", err)
+	}
+	if err := dec.Decode(&yaml.Node{}); !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("the CI file has more than one yaml document")
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return "", fmt.Errorf("the CI file is not a yaml mapping")
+	}
+
+	i := keyIndex(root, "include")
+	if i < 0 {
+		return insertBlock(current, root, managed, eol), nil
+	}
+	key, value := root.Content[i], root.Content[i+1]
+	if value.Kind == yaml.AliasNode {
+		return "", fmt.Errorf("line %d: an include that is an alias is not supported", value.Line)
+	}
+
+	// the comments after the include are kept in place by splice, the
+	// nodes ending it before the merge must not write them again
+	clearFootComments(value)
+	merged, changed := mergeEntries(entries(value), want)
+	if !changed {
+		return current, nil
+	}
+	switch {
+	case value.Kind == yaml.SequenceNode:
+		value.Content = merged
+	case len(merged) == 1:
+		value = merged[0]
+	default:
+		value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: merged}
+	}
+
+	var next *yaml.Node
+	if i+2 < len(root.Content) {
+		next = root.Content[i+2]
+	}
+	block, err := encode(key, value)
+	if err != nil {
+		return "", err
+	}
+	return splice(current, key, next, withLineEnding(block, eol)), nil
+}
+
+// managedEntries returns the include entries of the managed CI file
+func managedEntries(managed string) ([]*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(managed), &doc); err != nil {
+		return nil, fmt.Errorf("invalid managed include: %v", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode ||
+		len(doc.Content[0].Content) != 2 || doc.Content[0].Content[0].Value != "include" {
+		return nil, fmt.Errorf("the managed CI file must only have an include key")
+	}
+	list := entries(doc.Content[0].Content[1])
+	for _, e := range list {
+		if kind, _ := identity(e); kind == "" {
+			return nil, fmt.Errorf("line %d: an include entry is a string or has a project, local, remote, template or component key", e.Line)
+		}
+	}
+	return list, nil
+}
+
+// entries lists the include entries of the string, list and map forms
+func entries(value *yaml.Node) []*yaml.Node {
+	switch {
+	case value.Kind == yaml.SequenceNode:
+		return append([]*yaml.Node{}, value.Content...)
+	case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+		return nil
+	}
+	return []*yaml.Node{value}
+}
+
+// identity is what include entries are matched on: the kind of the entry,
+// or project:<path>, and its files
+func identity(e *yaml.Node) (string, []string) {
+	e = resolve(e)
+	switch e.Kind {
+	case yaml.ScalarNode:
+		// a string is a remote url or a local path
+		if strings.Contains(e.Value, "://") {
+			return "remote", []string{e.Value}
+		}
+		return "local", []string{e.Value}
+	case yaml.MappingNode:
+		if project := mapValue(e, "project"); project != nil {
+			files := []string{}
+			if file := mapValue(e, "file"); file != nil {
+				for _, f := range entries(resolve(file)) {
+					files = append(files, resolve(f).Value)
+				}
+			}
+			return "project:" + project.Value, files
+		}
+		for _, kind := range []string{"local", "remote", "template", "component"} {
+			if v := mapValue(e, kind); v != nil {
+				return kind, []string{resolve(v).Value}
+			}
+		}
+	}
+	return "", nil
+}
+
+// matches reports whether the existing entry e is the managed entry m, the
+// entries of a project match when they share a file
+func matches(e, m *yaml.Node) bool {
+	ekind, efiles := identity(e)
+	mkind, mfiles := identity(m)
+	if ekind == "" || ekind != mkind {
+		return false
+	}
+	if len(efiles) == 0 && len(mfiles) == 0 {
+		return true
+	}
+	for _, ef := range efiles {
+		for _, mf := range mfiles {
+			if ef == mf {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mergeEntries updates the existing entries that match a managed one and
+// appends the others
+func mergeEntries(list, want []*yaml.Node) ([]*yaml.Node, bool) {
+	used := make([]bool, len(list))
+	matched := make([]int, len(want))
+	for j := range matched {
+		matched[j] = -1
+	}
+	for j, m := range want {
+		for i, e := range list {
+			if !used[i] && matches(e, m) {
+				used[i], matched[j] = true, i
+				break
+			}
+		}
+	}
+
+	changed := false
+	for j, m := range want {
+		i := matched[j]
+		if i < 0 {
+			list = append(list, copyNode(m))
+			changed = true
+			continue
+		}
+		var updated bool
+		list[i], updated = update(list[i], m)
+		changed = changed || updated
+	}
+	return list, changed
+}
+
+// update sets the keys of the managed entry m on the existing entry e, the
+// other keys of e, like rules or inputs, are kept and so are the files it
+// includes besides the managed ones
+func update(e, m *yaml.Node) (*yaml.Node, bool) {
+	if m.Kind == yaml.ScalarNode {
+		return e, false
+	}
+	if e.Kind != yaml.MappingNode {
+		if equal(e, m) || equal(expand(e), m) {
+			return e, false
+		}
+		return copyNode(m), true
+	}
+	changed := false
+	for i := 0; i < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		j := keyIndex(e, key.Value)
+		switch {
+		case j < 0:
+			e.Content = append(e.Content, copyNode(key), copyNode(value))
+			changed = true
+		case key.Value == "file":
+			var added bool
+			e.Content[j+1], added = addFiles(e.Content[j+1], value)
+			changed = changed || added
+		case !equal(e.Content[j+1], value):
+			old := e.Content[j+1]
+			e.Content[j+1] = copyNode(value)
+			e.Content[j+1].LineComment = old.LineComment
+			changed = true
+		}
+	}
+	return e, changed
+}
+
+// addFiles adds the managed files of m missing from the file value e
+func addFiles(e, m *yaml.Node) (*yaml.Node, bool) {
+	have := map[string]bool{}
+	for _, f := range entries(resolve(e)) {
+		have[resolve(f).Value] = true
+	}
+	missing := []*yaml.Node{}
+	for _, f := range entries(resolve(m)) {
+		if !have[resolve(f).Value] {
+			missing = append(missing, copyNode(f))
+		}
+	}
+	if len(missing) == 0 {
+		return e, false
+	}
+	if e.Kind == yaml.SequenceNode {
+		e.Content = append(e.Content, missing...)
+		return e, true
+	}
+	files := []*yaml.Node{}
+	for _, f := range entries(resolve(e)) {
+		files = append(files, copyNode(resolve(f)))
+	}
+	return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: append(files, missing...)}, true
+}
+
+// expand is the map form of a string entry
+func expand(e *yaml.Node) *yaml.Node {
+	kind, values := identity(e)
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: kind},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[0]},
+	}}
+}
+
+// encode writes the include key and its value as a yaml block
+func encode(key, value *yaml.Node) (string, error) {
+	key = copyNode(key)
+	key.HeadComment, key.FootComment = "", ""
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{key, value}}); err != nil {
+		return "", err
+	}
+	if err := enc.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// clearFootComments drops the foot comments of value and of the nodes that
+// end it, they are the comment lines between the include and the next key.
+// The foot comment of a map entry is on its key.
+func clearFootComments(value *yaml.Node) {
+	for n := value; n != nil; {
+		n.FootComment = ""
+		if len(n.Content) == 0 {
+			break
+		}
+		if n.Kind == yaml.MappingNode {
+			n.Content[len(n.Content)-2].FootComment = ""
+		}
+		n = n.Content[len(n.Content)-1]
+	}
+}
+
+// splice replaces the lines of the include key, from its line to the line
+// before the next key less the blank and comment lines ending them, with
+// block
+func splice(current string, key, next *yaml.Node, block string) string {
+	lines := strings.SplitAfter(current, "\n")
+	start, end := key.Line-1, len(lines)
+	if next != nil {
+		end = next.Line - 1
+	}
+	for end > start+1 && isBlankOrComment(lines[end-1]) {
+		end--
+	}
+	rest := strings.Join(lines[end:], "")
+	if end == len(lines) && !strings.HasSuffix(current, "\n") {
+		block = strings.TrimSuffix(block, "\n")
+	}
+	return strings.Join(lines[:start], "") + block + rest
+}
+
+// insertBlock puts the managed include before the first key of the file
+// and the comment lines right above it
+func insertBlock(current string, root *yaml.Node, managed, eol string) string {
+	lines := strings.SplitAfter(current, "\n")
+	at := root.Content[0].Line - 1
+	for at > 0 && strings.HasPrefix(strings.TrimSpace(lines[at-1]), "#") {
+		at--
+	}
+	if !strings.HasSuffix(managed, "\n") {
+		managed += eol
+	}
+	return strings.Join(lines[:at], "") + managed + eol + strings.Join(lines[at:], "")
+}
+
+// appendBlock adds the managed include after the comments of a file that
+// only has comments
+func appendBlock(current, managed, eol string) string {
+	if !strings.HasSuffix(current, "\n") {
+		current += eol
+	}
+	return current + eol + managed
+}
+
+// lineEnding is \r\n when the first line of s ends with it, else \n
+func lineEnding(s string) string {
+	if i := strings.Index(s, "\n"); i > 0 && s[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// withLineEnding ends the lines of s, written with \n, with eol
+func withLineEnding(s, eol string) string {
+	if eol == "\n" {
+		return s
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", eol)
+}
+
+func isBlankOrComment(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+func keyIndex(m *yaml.Node, key string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func mapValue(m *yaml.Node, key string) *yaml.Node {
+	if i := keyIndex(m, key); i >= 0 {
+		return m.Content[i+1]
+	}
+	return nil
+}
+
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// equal compares the values of two nodes, their style and comments aside
+func equal(a, b *yaml.Node) bool {
+	var av, bv interface{}
+	if a.Decode(&av) != nil || b.Decode(&bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+func copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	c.Content = nil
+	for _, child := range n.Content {
+		c.Content = append(c.Content, copyNode(child))
+	}
+	return &c
+}
@@ -0,0 +1,227 @@
+package ciinclude
+
+import "testing"
+
+const managed = `include:
+  - project: ci/templates
+    ref: v2
+    file: common.yml
+  - local: /ci/rules.yml
+`
+
+func TestMerge(t *testing.T) {
+	tests := map[string]struct {
+		current, want string
+	}{
+		"missing file": {
+			current: "",
+			want:    managed,
+		},
+		"only comments": {
+			current: "# pipeline of the app\n",
+			want:    "# pipeline of the app\n\n" + managed,
+		},
+		"no include": {
+			current: `# pipeline of the app
+
+# build it
+build: &build
+  script: make   # all targets
+
+test:
+  <<: *build
+`,
+			want: `# pipeline of the app
+
+include:
+  - project: ci/templates
+    ref: v2
+    file: common.yml
+  - local: /ci/rules.yml
+
+# build it
+build: &build
+  script: make   # all targets
+
+test:
+  <<: *build
+`,
+		},
+		"string form": {
+			current: `include: '/ci/rules.yml'
+
+build:
+  script: make
+`,
+			want: `include:
+  - '/ci/rules.yml'
+  - project: ci/templates
+    ref: v2
+    file: common.yml
+
+build:
+  script: make
+`,
+		},
+		"map form": {
+			current: `stages: [build]
+include:
+  project: ci/templates
+  ref: v1   # pinned
+  file: common.yml
+# the jobs
+build:
+  script: make
+`,
+			want: `stages: [build]
+include:
+  - project: ci/templates
+    ref: v2 # pinned
+    file: common.yml
+  - local: /ci/rules.yml
+# the jobs
+build:
+  script: make
+`,
+		},
+		"list form": {
+			current: `include:
+  # ours
+  - local: /ci/team.yml
+  - project: ci/templates
+    file: [common.yml, extra.yml]
+    rules:
+      - if: $CI_COMMIT_TAG
+
+build:
+  script: make
+`,
+			want: `include:
+  # ours
+  - local: /ci/team.yml
+  - project: ci/templates
+    file: [common.yml, extra.yml]
+    rules:
+      - if: $CI_COMMIT_TAG
+    ref: v2
+  - local: /ci/rules.yml
+
+build:
+  script: make
+`,
+		},
+		"other file of the project": {
+			current: `include:
+  - project: ci/templates
+    file: old.yml
+build:
+  script: make
+`,
+			want: `include:
+  - project: ci/templates
+    file: old.yml
+  - project: ci/templates
+    ref: v2
+    file: common.yml
+  - local: /ci/rules.yml
+build:
+  script: make
+`,
+		},
+		"comment after the include": {
+			current: `include:
+  - local: a.yml
+  # trailing comment about a
+build:
+  script: make
+`,
+			want: `include:
+  - local: a.yml
+  - project: ci/templates
+    ref: v2
+    file: common.yml
+  - local: /ci/rules.yml
+  # trailing comment about a
+build:
+  script: make
+`,
+		},
+		"crlf": {
+			current: "include:\r\n  - local: a.yml\r\n\r\nbuild:\r\n  script: make\r\n",
+			want:    "include:\r\n  - local: a.yml\r\n  - project: ci/templates\r\n    ref: v2\r\n    file: common.yml\r\n  - local: /ci/rules.yml\r\n\r\nbuild:\r\n  script: make\r\n",
+		},
+		"crlf without include": {
+			current: "# pipeline of the app\r\nbuild:\r\n  script: make\r\n",
+			want:    "include:\r\n  - project: ci/templates\r\n    ref: v2\r\n    file: common.yml\r\n  - local: /ci/rules.yml\r\n\r\n# pipeline of the app\r\nbuild:\r\n  script: make\r\n",
+		},
+		"up to date": {
+			current: `include:
+- local: /ci/rules.yml    # shared rules
+- {project: ci/templates, file: common.yml, ref: v2}
+build: {script: make}`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tt.want == "" {
+				tt.want = tt.current
+			}
+			got, err := Merge(tt.current, managed)
+			if err != nil {
+				t.Fatalf("Merge: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected:\n%s\ngot:\n%s", tt.want, got)
+			}
+			if again, err := Merge(got, managed); err != nil || again != got {
+				t.Errorf("Expected a second Merge to keep the file, got:\n%s\n%v", again, err)
+			}
+		})
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	managed := "include:\n  - project: ci/templates\n    file: [common.yml, lint.yml]\n"
+	current := `include:
+  - project: ci/templates
+    file: common.yml
+`
+	want := `include:
+  - project: ci/templates
+    file:
+      - common.yml
+      - lint.yml
+`
+	got, err := Merge(current, managed)
+	if err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+	if got != want {
+		t.Errorf("Expected the missing file added:\n%s\ngot:\n%s", want, got)
+	}
+
+	current = "include:\n  - project: ci/templates\n    file: [extra.yml, lint.yml, common.yml]\n"
+	if got, err := Merge(current, managed); err != nil || got != current {
+		t.Errorf("Expected the file list kept, got:\n%s\n%v", got, err)
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	tests := map[string]struct {
+		current, managed string
+	}{
+		"managed jobs":    {current: "", managed: "include: a.yml\nbuild:\n  script: make\n"},
+		"managed entry":   {current: "", managed: "include:\n  - rules: []\n"},
+		"not a mapping":   {current: "- a\n", managed: managed},
+		"two documents":   {current: "spec: {}\n---\nbuild: {}\n", managed: managed},
+		"alias include":   {current: "x: &x [a.yml]\ninclude: *x\n", managed: managed},
+		"invalid current": {current: "build: [\n", managed: managed},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Merge(tt.current, tt.managed); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package cilint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"gitlab-vault/gitlab"
+)
+
+// DefaultMaxFailureRate aborts the run when more than a tenth of the
+// projects fail the lint
+const DefaultMaxFailureRate = 0.1
+
+// workers lint the projects concurrently, the gitlab client limits the rate
+const workers = 8
+
+type Config struct {
+	// Disabled writes the CI file without linting it
+	Disabled bool `koanf:"disabled"`
+	// MaxFailureRate is the share of projects, from 0 to 1, that may fail
+	// the lint before the whole run is aborted
+	MaxFailureRate float64 `koanf:"max_failure_rate"`
+}
+
+// Linter lints a CI file in a project, gitlab.GitlabInfo implements it
+type Linter interface {
+	LintCi(ctx context.Context, gr *gitlab.GitlabResp, content string) (*gitlab.LintResult, error)
+}
+
+// Failure is a project whose CI file is invalid or could not be linted
+type Failure struct {
+	Project string
+	Errors  []string
+}
+
+type Checker struct {
+	Gitlab Linter
+	Config Config
+}
+
+// Validate checks the configuration before any project is linted
+func (c *Checker) Validate() error {
+	if c.Config.MaxFailureRate < 0 || c.Config.MaxFailureRate > 1 {
+		return fmt.Errorf("ci_lint.max_failure_rate %v is not between 0 and 1", c.Config.MaxFailureRate)
+	}
+	return nil
+}
+
+// Check lints the CI file render returns for each project, an empty one
+// passes. It returns the projects that passed and the failures, and an
+// error when the failures exceed MaxFailureRate.
+func (c *Checker) Check(ctx context.Context, projects []*gitlab.GitlabResp, render func(gr *gitlab.GitlabResp) (string, error)) ([]*gitlab.GitlabResp, []Failure, error) {
+	if c.Config.Disabled {
+		return projects, nil, nil
+	}
+
+	errs := make([][]string, len(projects))
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+	for range min(workers, len(projects)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = c.lint(ctx, projects[i], render)
+			}
+		}()
+	}
+	for i := range projects {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	valid := []*gitlab.GitlabResp{}
+	failures := []Failure{}
+	for i, gr := range projects {
+		if errs[i] == nil {
+			valid = append(valid, gr)
+			continue
+		}
+		failures = append(failures, Failure{Project: gr.Path(), Errors: errs[i]})
+	}
+
+	if len(projects) > 0 {
+		rate := float64(len(failures)) / float64(len(projects))
+		if rate > c.Config.MaxFailureRate {
+			return valid, failures, fmt.Errorf("%d of %d projects failed the CI lint, above the %.0f%% threshold", len(failures), len(projects), c.Config.MaxFailureRate*100)
+		}
+	}
+	return valid, failures, nil
+}
+
+// lint returns the errors of the project CI file, nil when it is valid
+func (c *Checker) lint(ctx context.Context, gr *gitlab.GitlabResp, render func(gr *gitlab.GitlabResp) (string, error)) []string {
+	content, err := render(gr)
+	if err != nil {
+		return []string{fmt.Sprintf("could not render the CI file: %v", err)}
+	}
+	if content == "" {
+		// the project gets no CI file
+		return nil
+	}
+	result, err := c.Gitlab.LintCi(ctx, gr, content)
+	if err != nil {
+		return []string{fmt.Sprintf("could not lint: %v", err)}
+	}
+	if !result.Valid {
+		if len(result.Errors) == 0 {
+			return []string{"invalid"}
+		}
+		return result.Errors
+	}
+	return nil
+}
+
+// Report writes the failures as a table
+func Report(w io.Writer, failures []Failure) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tCI LINT ERRORS")
+	for _, f := range failures {
+		fmt.Fprintf(tw, "%s\t%s\n", f.Project, strings.Join(f.Errors, "; "))
+	}
+	tw.Flush()
+}
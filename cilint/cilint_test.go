@@ -0,0 +1,96 @@
+package cilint
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+)
+
+type fakeLinter map[string]*gitlab.LintResult
+
+func (f fakeLinter) LintCi(ctx context.Context, gr *gitlab.GitlabResp, content string) (*gitlab.LintResult, error) {
+	result, ok := f[gr.ProjectId]
+	if !ok {
+		return nil, errors.New("500 Internal Server Error")
+	}
+	return result, nil
+}
+
+func projects(n int) []*gitlab.GitlabResp {
+	prs := []*gitlab.GitlabResp{}
+	for i := 1; i <= n; i++ {
+		id := string(rune('0' + i))
+		prs = append(prs, &gitlab.GitlabResp{ProjectId: id, ProjectPath: "grp/p" + id})
+	}
+	return prs
+}
+
+func render(gr *gitlab.GitlabResp) (string, error) {
+	if gr.ProjectId == "4" {
+		return "", errors.New(`map has no entry for key "Topics"`)
+	}
+	return "include: []\n", nil
+}
+
+func TestCheck(t *testing.T) {
+	linter := fakeLinter{
+		"1": {Valid: true},
+		"2": {Valid: false, Errors: []string{"jobs config should contain at least one visible job"}},
+		"4": {Valid: true},
+		"5": {Valid: true, Warnings: []string{"jobs:test may allow multiple pipelines"}},
+	}
+	c := &Checker{Gitlab: linter, Config: Config{MaxFailureRate: 0.6}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	valid, failures, err := c.Check(context.Background(), projects(5), render)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(valid) != 2 || valid[0].ProjectId != "1" || valid[1].ProjectId != "5" {
+		t.Errorf("Expected projects 1 and 5 to pass, got %v", valid)
+	}
+	want := []Failure{
+		{Project: "grp/p2", Errors: []string{"jobs config should contain at least one visible job"}},
+		{Project: "grp/p3", Errors: []string{"could not lint: 500 Internal Server Error"}},
+		{Project: "grp/p4", Errors: []string{`could not render the CI file: map has no entry for key "Topics"`}},
+	}
+	if !reflect.DeepEqual(failures, want) {
+		t.Errorf("Expected failures:\n%v\ngot:\n%v", want, failures)
+	}
+
+	var buf bytes.Buffer
+	Report(&buf, failures)
+	if !strings.Contains(buf.String(), "at least one visible job") {
+		t.Errorf("Expected the lint errors in the report, got:\n%s", buf.String())
+	}
+
+	// 3 of 5 is above 50%
+	c.Config.MaxFailureRate = 0.5
+	if _, _, err := c.Check(context.Background(), projects(5), render); err == nil {
+		t.Error("Expected the run to be aborted above the threshold")
+	}
+}
+
+func TestCheckDisabled(t *testing.T) {
+	c := &Checker{Gitlab: fakeLinter{}, Config: Config{Disabled: true}}
+	valid, failures, err := c.Check(context.Background(), projects(2), render)
+	if err != nil || len(valid) != 2 || len(failures) != 0 {
+		t.Errorf("Expected every project to pass, got %v %v %v", valid, failures, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1.5} {
+		c := &Checker{Config: Config{MaxFailureRate: rate}}
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected an error for max_failure_rate %v", rate)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package deploykey
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/varsync"
+	"gitlab-vault/vault"
+)
+
+// DefaultTitle is the title of the deploy keys the tool manages, keys with
+// another title are never touched
+const DefaultTitle = "gitlab-vault"
+
+// Statuses of a project deploy key after Ensure
+const (
+	Created   = "created"
+	Rotated   = "rotated"
+	Unchanged = "unchanged"
+)
+
+type Config struct {
+	// Path is the <mount>/<path> of the per-project secret holding the
+	// private key, {{project}} and {{project_id}} are replaced with the full
+	// path and the id of each project
+	Path    string `koanf:"path"`
+	Title   string `koanf:"title"`
+	CanPush bool   `koanf:"can_push"`
+	// MaxAge rotates keys registered for longer, zero never rotates
+	MaxAge time.Duration `koanf:"max_age"`
+	// SshMount and SshRole, when set, have the vault ssh CA sign the public
+	// key, the certificate is stored next to the private key
+	SshMount string `koanf:"ssh_mount"`
+	SshRole  string `koanf:"ssh_role"`
+}
+
+// SecretStore reads and writes kv secrets, vault.Lifecycle implements it
+type SecretStore interface {
+	ReadSecret(ctx context.Context, mount, path string) (map[string]interface{}, error)
+	WriteSecret(ctx context.Context, mount, path string, data map[string]interface{}) error
+}
+
+// Signer signs ssh public keys, vault.Lifecycle implements it
+type Signer interface {
+	SignSshKey(ctx context.Context, mount, role, publicKey string) (string, error)
+}
+
+// Result is the deploy key of one project after Ensure
+type Result struct {
+	Project string
+	KeyId   int
+	Status  string
+	// Removed are the ids of the replaced deploy keys
+	Removed []int
+}
+
+type Manager struct {
+	Gitlab  *gitlab.GitlabInfo
+	Secrets SecretStore
+	// Signer is only used when Config.SshRole is set
+	Signer Signer
+	Config Config
+
+	// now is time.Now, tests replace it
+	now func() time.Time
+}
+
+// Validate checks the configuration before any project is processed
+func (m *Manager) Validate() error {
+	if _, _, _, err := varsync.ParseSource(m.Config.Path + "#field"); err != nil {
+		return fmt.Errorf("invalid deploy_keys.path: %v", err)
+	}
+	if m.Config.Title == "" {
+		m.Config.Title = DefaultTitle
+	}
+	if m.Config.MaxAge < 0 {
+		return fmt.Errorf("invalid deploy_keys.max_age %s", m.Config.MaxAge)
+	}
+	if m.Config.SshRole != "" && m.Signer == nil {
+		return errors.New("deploy_keys.ssh_role is set but there is no ssh signer")
+	}
+	if m.Config.SshRole != "" && m.Config.SshMount == "" {
+		m.Config.SshMount = "ssh"
+	}
+	return nil
+}
+
+func (m *Manager) time() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// Ensure gives the project a deploy key whose private key is in its vault
+// secret. A key older than MaxAge is replaced, the new key is registered and
+// stored before the old one is removed.
+func (m *Manager) Ensure(ctx context.Context, gr *gitlab.GitlabResp) (*Result, error) {
+	mount, path, _, err := varsync.ParseSource(gr.Expand(m.Config.Path) + "#field")
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Project: gr.ProjectName}
+
+	secret, err := m.Secrets.ReadSecret(ctx, mount, path)
+	if err != nil && !errors.Is(err, vault.ErrSecretNotFound) {
+		return nil, fmt.Errorf("could not read %s/%s: %v", mount, path, err)
+	}
+	keys, err := m.Gitlab.ListDeployKeys(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the key in use is the one the secret points to
+	currentId := keyId(secret["deploy_key_id"])
+	var current *time.Time
+	found := false
+	for _, k := range keys {
+		if k.ID == currentId && currentId != 0 {
+			current, found = k.CreatedAt, true
+			break
+		}
+	}
+	if found {
+		result.KeyId = currentId
+		if m.Config.MaxAge == 0 || current == nil || m.time().Sub(*current) < m.Config.MaxAge {
+			result.Status = Unchanged
+			return result, nil
+		}
+		result.Status = Rotated
+	} else {
+		result.Status = Created
+	}
+
+	data, publicKey, err := m.generate(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+	id, err := m.Gitlab.AddDeployKey(ctx, gr, m.Config.Title, publicKey, m.Config.CanPush)
+	if err != nil {
+		return nil, fmt.Errorf("could not add the deploy key: %v", err)
+	}
+	data["deploy_key_id"] = strconv.Itoa(id)
+	if err := m.Secrets.WriteSecret(ctx, mount, path, data); err != nil {
+		// the new key is of no use without its private key
+		if err := m.Gitlab.DeleteDeployKey(ctx, gr, id); err != nil {
+			return nil, fmt.Errorf("could not remove the unstored deploy key %d: %v", id, err)
+		}
+		return nil, fmt.Errorf("could not write %s/%s: %v", mount, path, err)
+	}
+	result.KeyId = id
+
+	// remove the replaced key and any other key left by an earlier run
+	var errs []error
+	for _, k := range keys {
+		if k.Title != m.Config.Title || k.ID == id {
+			continue
+		}
+		if err := m.Gitlab.DeleteDeployKey(ctx, gr, k.ID); err != nil {
+			errs = append(errs, fmt.Errorf("could not remove deploy key %d: %v", k.ID, err))
+			continue
+		}
+		result.Removed = append(result.Removed, k.ID)
+	}
+	return result, errors.Join(errs...)
+}
+
+// generate returns the secret data of a new ed25519 keypair and its
+// authorized_keys line
+func (m *Manager) generate(ctx context.Context, gr *gitlab.GitlabResp) (map[string]interface{}, string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	comment := m.Config.Title + "@" + gr.ProjectName
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, "", err
+	}
+	publicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " " + comment
+
+	data := map[string]interface{}{
+		"private_key": string(pem.EncodeToMemory(block)),
+		"public_key":  publicKey,
+		"created_at":  m.time().UTC().Format(time.RFC3339),
+	}
+	if m.Config.SshRole != "" {
+		cert, err := m.Signer.SignSshKey(ctx, m.Config.SshMount, m.Config.SshRole, publicKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not sign the public key: %v", err)
+		}
+		data["certificate"] = cert
+	}
+	return data, publicKey, nil
+}
+
+// keyId reads the deploy key id stored in the secret, vault returns numbers
+// as json.Number or strings
+func keyId(v interface{}) int {
+	id, _ := strconv.Atoi(fmt.Sprint(v))
+	return id
+}
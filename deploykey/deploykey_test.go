@@ -0,0 +1,206 @@
+package deploykey
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/internal/testutil"
+)
+
+type fakeSigner struct{}
+
+func (fakeSigner) SignSshKey(ctx context.Context, mount, role, publicKey string) (string, error) {
+	return "cert-" + mount + "-" + role, nil
+}
+
+type deployKey struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	Key       string    `json:"key"`
+	CanPush   bool      `json:"can_push"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// setupMockDeployKeys serves the deploy keys of project 1, new keys get ids
+// from 100
+func setupMockDeployKeys(t *testing.T, keys []deployKey) (*httptest.Server, *[]deployKey, *[]string) {
+	var mu sync.Mutex
+	writes := []string{}
+	nextId := 100
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/deploy_keys", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(keys)
+		case http.MethodPost:
+			var body deployKey
+			json.NewDecoder(r.Body).Decode(&body)
+			body.ID = nextId
+			body.CreatedAt = time.Now()
+			nextId++
+			keys = append(keys, body)
+			writes = append(writes, fmt.Sprintf("add %d %s can_push=%v", body.ID, body.Title, body.CanPush))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(body)
+		}
+	})
+	mux.HandleFunc("/api/v4/projects/1/deploy_keys/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/deploy_keys/")
+		for i, k := range keys {
+			if fmt.Sprint(k.ID) == id {
+				keys = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+		writes = append(writes, "delete "+id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &keys, &writes
+}
+
+func TestEnsure(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	path := "secret/mor/grp/myproject/deploy-key"
+	tests := []struct {
+		name       string
+		keys       []deployKey
+		secret     map[string]interface{}
+		wantStatus string
+		wantWrites []string
+	}{
+		{
+			name:       "new project",
+			wantStatus: Created,
+			wantWrites: []string{"add 100 gitlab-vault can_push=false"},
+		},
+		{
+			name: "fresh key",
+			keys: []deployKey{
+				{ID: 7, Title: DefaultTitle, CreatedAt: now.Add(-24 * time.Hour)},
+			},
+			secret:     map[string]interface{}{"deploy_key_id": "7"},
+			wantStatus: Unchanged,
+			wantWrites: []string{},
+		},
+		{
+			name: "expired key",
+			keys: []deployKey{
+				{ID: 7, Title: DefaultTitle, CreatedAt: now.Add(-60 * 24 * time.Hour)},
+				{ID: 8, Title: "team key", CreatedAt: now.Add(-60 * 24 * time.Hour)},
+			},
+			secret:     map[string]interface{}{"deploy_key_id": "7"},
+			wantStatus: Rotated,
+			wantWrites: []string{"add 100 gitlab-vault can_push=false", "delete 7"},
+		},
+		{
+			name: "key removed from gitlab",
+			keys: []deployKey{
+				{ID: 8, Title: "team key", CreatedAt: now},
+			},
+			secret:     map[string]interface{}{"deploy_key_id": "7"},
+			wantStatus: Created,
+			wantWrites: []string{"add 100 gitlab-vault can_push=false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _, writes := setupMockDeployKeys(t, tt.keys)
+			store := testutil.NewSecretStore(nil)
+			if tt.secret != nil {
+				store.Secrets[path] = tt.secret
+			}
+			m := &Manager{
+				Gitlab:  &gitlab.GitlabInfo{Token: "test", BaseURL: server.URL + "/api/v4"},
+				Secrets: store,
+				Config: Config{
+					Path:   "secret/mor/{{project}}/deploy-key",
+					MaxAge: 30 * 24 * time.Hour,
+				},
+				now: func() time.Time { return now },
+			}
+			if err := m.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+
+			result, err := m.Ensure(context.Background(), &gitlab.GitlabResp{ProjectName: "myproject", ProjectPath: "grp/myproject", ProjectId: "1"})
+			if err != nil {
+				t.Fatalf("Ensure: %v", err)
+			}
+			if result.Status != tt.wantStatus {
+				t.Errorf("Expected status %s, got %s", tt.wantStatus, result.Status)
+			}
+			if strings.Join(*writes, ",") != strings.Join(tt.wantWrites, ",") {
+				t.Errorf("Expected writes %v, got %v", tt.wantWrites, *writes)
+			}
+			if tt.wantStatus == Unchanged {
+				return
+			}
+
+			data := store.Secrets[path]
+			if data["deploy_key_id"] != "100" {
+				t.Errorf("Expected the new key id in the secret, got %v", data["deploy_key_id"])
+			}
+			if _, err := ssh.ParseRawPrivateKey([]byte(data["private_key"].(string))); err != nil {
+				t.Errorf("Expected a valid private key: %v", err)
+			}
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data["public_key"].(string))); err != nil {
+				t.Errorf("Expected a valid public key: %v", err)
+			}
+		})
+	}
+}
+
+func TestEnsureSigned(t *testing.T) {
+	server, _, _ := setupMockDeployKeys(t, nil)
+	store := testutil.NewSecretStore(nil)
+	m := &Manager{
+		Gitlab:  &gitlab.GitlabInfo{Token: "test", BaseURL: server.URL + "/api/v4"},
+		Secrets: store,
+		Signer:  fakeSigner{},
+		Config: Config{
+			Path:    "secret/mor/{{project}}/deploy-key",
+			SshRole: "deploy",
+		},
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if _, err := m.Ensure(context.Background(), &gitlab.GitlabResp{ProjectName: "myproject", ProjectPath: "grp/myproject", ProjectId: "1"}); err != nil {
+		t.Fatalf("Ensure: %v", err)
+	}
+	if cert := store.Secrets["secret/mor/grp/myproject/deploy-key"]["certificate"]; cert != "cert-ssh-deploy" {
+		t.Errorf("Expected the signed certificate, got %v", cert)
+	}
+}
+
+func TestValidateSigner(t *testing.T) {
+	m := &Manager{Config: Config{Path: "secret/mor/{{project}}/deploy-key", SshRole: "deploy"}}
+	if err := m.Validate(); err == nil {
+		t.Error("Expected an error for ssh_role without a signer")
+	}
+	m = &Manager{Config: Config{Path: "secret/mor/{{project}}/deploy-key"}}
+	if err := m.Validate(); err != nil {
+		t.Errorf("Unexpected error without ssh_role: %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package fileset
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"gitlab-vault/block"
+	"gitlab-vault/ciinclude"
+	"gitlab-vault/gitlab"
+	"gitlab-vault/render"
+	"gitlab-vault/selection"
+)
+
+// Suffix is stripped from the template names, the rest is the repository path
+const Suffix = ".tmpl"
+
+// Modes of a managed file
+const (
+	// Update writes the file whenever its content differs, the default
+	Update = "update"
+	// Create only writes the file when it is missing
+	Create = "create"
+	// Block only writes the block between the markers, appended to the
+	// file when they are missing
+	Block = "block"
+	// Include only adds or updates the include entries of the template in
+	// the CI file, the jobs of the project are left as is
+	Include = "include"
+	// Delete removes the file from the projects that have it, the template
+	// has no content
+	Delete = "delete"
+)
+
+// FrontMatter is the yaml block between two --- lines at the top of a
+// template
+type FrontMatter struct {
+	Mode string `yaml:"mode"`
+	// Markers delimit the block of the block mode, block.DefaultMarkers
+	// when empty
+	Markers block.Markers `yaml:"markers"`
+	// When selects the projects that get the file, like the projects of
+	// the zone
+	When selection.Config `yaml:"when"`
+}
+
+// Template is a managed file, Path is its path in the repositories
+type Template struct {
+	Path        string
+	FrontMatter FrontMatter
+
+	selector *selection.Selector
+	tpl      *render.Template
+}
+
+// Set is the managed files of a templates directory
+type Set struct {
+	Templates []*Template
+	// CiPath maps the CI file, gitlab.DefaultCiConfigPath in the directory,
+	// to the CI config path of each project
+	CiPath func(gr *gitlab.GitlabResp) (string, error)
+}
+
+// Load parses every file of the directory as a managed file template.
+// Labels checks the label conditions, it may be nil when no file has any.
+func Load(fsys fs.FS, engine *render.Engine, labels selection.LabelLister) (*Set, error) {
+	set := &Set{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		t, err := parse(name, content, engine, labels)
+		if err != nil {
+			return fmt.Errorf("template %s: %v", name, err)
+		}
+		set.Templates = append(set.Templates, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(set.Templates) == 0 {
+		return nil, fmt.Errorf("the templates directory is empty")
+	}
+
+	sort.Slice(set.Templates, func(i, j int) bool { return set.Templates[i].Path < set.Templates[j].Path })
+	for i := 1; i < len(set.Templates); i++ {
+		if set.Templates[i].Path == set.Templates[i-1].Path {
+			return nil, fmt.Errorf("two templates for %s", set.Templates[i].Path)
+		}
+	}
+	return set, nil
+}
+
+func parse(name string, content []byte, engine *render.Engine, labels selection.LabelLister) (*Template, error) {
+	t := &Template{Path: strings.TrimSuffix(name, Suffix)}
+
+	body, err := splitFrontMatter(content, &t.FrontMatter)
+	if err != nil {
+		return nil, err
+	}
+	switch t.FrontMatter.Mode {
+	case "":
+		t.FrontMatter.Mode = Update
+	case Update, Create, Block, Include, Delete:
+	default:
+		return nil, fmt.Errorf("unknown mode %q, want %s, %s, %s, %s or %s", t.FrontMatter.Mode, Update, Create, Block, Include, Delete)
+	}
+	if t.FrontMatter.Mode == Delete && strings.TrimSpace(body) != "" {
+		return nil, fmt.Errorf("a file of the %s mode has no content", Delete)
+	}
+	if t.FrontMatter.Mode == Block {
+		markers := &t.FrontMatter.Markers
+		defaults := block.DefaultMarkers(t.Path)
+		if markers.Begin == "" {
+			markers.Begin = defaults.Begin
+		}
+		if markers.End == "" {
+			markers.End = defaults.End
+		}
+		if markers.Begin == markers.End || strings.Contains(markers.Begin+markers.End, "\n") {
+			return nil, fmt.Errorf("the markers must be two different lines")
+		}
+	}
+
+	if t.FrontMatter.Mode == Include && !t.IsCi() {
+		return nil, fmt.Errorf("the %s mode is only for %s", Include, gitlab.DefaultCiConfigPath)
+	}
+
+	t.selector = &selection.Selector{Labels: labels, Config: t.FrontMatter.When}
+	if err := t.selector.Validate(); err != nil {
+		return nil, err
+	}
+	if t.tpl, err = engine.Parse(t.Path, body); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// splitFrontMatter decodes the front matter, when the content starts with
+// one, and returns the rest
+func splitFrontMatter(content []byte, fm *FrontMatter) (string, error) {
+	rest, ok := bytes.CutPrefix(content, []byte("---\n"))
+	if !ok {
+		return string(content), nil
+	}
+	var header []byte
+	if h, ok := bytes.CutPrefix(rest, []byte("---\n")); ok {
+		header, rest = nil, h
+	} else {
+		var found bool
+		header, rest, found = bytes.Cut(rest, []byte("\n---\n"))
+		if !found {
+			return "", fmt.Errorf("the front matter has no closing ---")
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(header))
+	dec.KnownFields(true)
+	if err := dec.Decode(fm); err != nil && len(bytes.TrimSpace(header)) > 0 {
+		return "", fmt.Errorf("invalid front matter: %v", err)
+	}
+	return string(rest), nil
+}
+
+// IsCi reports whether the template is the CI file of the projects
+func (t *Template) IsCi() bool {
+	return t.Path == gitlab.DefaultCiConfigPath
+}
+
+// Files renders the managed files of the project, the ones whose conditions
+// the project does not meet are left out
+func (s *Set) Files(ctx context.Context, gr *gitlab.GitlabResp) ([]gitlab.File, error) {
+	files := []gitlab.File{}
+	for _, t := range s.Templates {
+		f, ok, err := s.render(ctx, t, gr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// Ci renders the CI file of the project, false when there is none for it
+func (s *Set) Ci(ctx context.Context, gr *gitlab.GitlabResp) (gitlab.File, bool, error) {
+	for _, t := range s.Templates {
+		if t.IsCi() {
+			return s.render(ctx, t, gr)
+		}
+	}
+	return gitlab.File{}, false, nil
+}
+
+func (s *Set) render(ctx context.Context, t *Template, gr *gitlab.GitlabResp) (gitlab.File, bool, error) {
+	selected, err := t.selector.Selects(ctx, gr)
+	if err != nil || !selected {
+		return gitlab.File{}, false, err
+	}
+	var content string
+	if t.FrontMatter.Mode != Delete {
+		if content, err = t.tpl.Render(gr); err != nil {
+			return gitlab.File{}, false, err
+		}
+	}
+
+	f := gitlab.File{Path: t.Path, Content: content, CreateOnly: t.FrontMatter.Mode == Create, Delete: t.FrontMatter.Mode == Delete}
+	switch t.FrontMatter.Mode {
+	case Block:
+		markers := t.FrontMatter.Markers
+		f.Merge = func(current string) (string, error) {
+			return block.Apply(current, content, markers)
+		}
+	case Include:
+		f.Merge = func(current string) (string, error) {
+			return ciinclude.Merge(current, content)
+		}
+	}
+	if t.IsCi() && s.CiPath != nil {
+		if f.Path, err = s.CiPath(gr); err != nil {
+			return gitlab.File{}, false, err
+		}
+	}
+	return f, true, nil
+}
@@ -0,0 +1,186 @@
+package fileset
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/render"
+)
+
+func testSet(t *testing.T) *Set {
+	t.Helper()
+	fsys := fstest.MapFS{
+		".gitlab-ci.yml.tmpl": {Data: []byte("include:\n  - project: ci/{{ .Zone }}\n")},
+		"README.md.tmpl": {Data: []byte(`---
+mode: create
+---
+# {{ .ProjectName }}
+`)},
+		".gitlab/CODEOWNERS.tmpl": {Data: []byte(`---
+when:
+  topics: ["go"]
+  exclude: ["/sandbox/"]
+---
+* @{{ .Namespace }}/maintainers
+`)},
+		"renovate.json": {Data: []byte("{}\n")},
+	}
+	set, err := Load(fsys, &render.Engine{Zone: "production"}, nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	set.CiPath = func(gr *gitlab.GitlabResp) (string, error) {
+		if gr.CiConfigPath != "" {
+			return gr.CiConfigPath, nil
+		}
+		return gitlab.DefaultCiConfigPath, nil
+	}
+	return set
+}
+
+func TestFiles(t *testing.T) {
+	set := testSet(t)
+	ctx := context.Background()
+
+	gr := &gitlab.GitlabResp{ProjectName: "api", ProjectPath: "grp/api", NamespacePath: "grp", Topics: []string{"go"}, CiConfigPath: "ci/pipeline.yml"}
+	files, err := set.Files(ctx, gr)
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	want := []gitlab.File{
+		{Path: "ci/pipeline.yml", Content: "include:\n  - project: ci/production\n"},
+		{Path: ".gitlab/CODEOWNERS", Content: "* @grp/maintainers\n"},
+		{Path: "README.md", Content: "# api\n", CreateOnly: true},
+		{Path: "renovate.json", Content: "{}\n"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected files:\n%+v\ngot:\n%+v", want, files)
+	}
+
+	// the conditions of CODEOWNERS leave these out
+	for _, gr := range []*gitlab.GitlabResp{
+		{ProjectName: "web", ProjectPath: "grp/web", Topics: []string{"js"}},
+		{ProjectName: "try", ProjectPath: "grp/sandbox/try", Topics: []string{"go"}},
+	} {
+		files, err := set.Files(ctx, gr)
+		if err != nil {
+			t.Fatalf("Files: %v", err)
+		}
+		if len(files) != 3 {
+			t.Errorf("Expected no CODEOWNERS for %s, got %+v", gr.ProjectPath, files)
+		}
+	}
+
+	ci, ok, err := set.Ci(ctx, gr)
+	if err != nil || !ok || ci.Content != "include:\n  - project: ci/production\n" {
+		t.Errorf("Unexpected CI file %+v, %v", ci, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"empty":         {},
+		"unknown mode":  {"a.tmpl": {Data: []byte("---\nmode: sometimes\n---\nx\n")}},
+		"unknown key":   {"a.tmpl": {Data: []byte("---\nif: go\n---\nx\n")}},
+		"unclosed":      {"a.tmpl": {Data: []byte("---\nmode: create\nx\n")}},
+		"bad condition": {"a.tmpl": {Data: []byte("---\nwhen:\n  include: [\"(\"]\n---\nx\n")}},
+		"labels":        {"a.tmpl": {Data: []byte("---\nwhen:\n  labels: [managed]\n---\nx\n")}},
+		"bad template":  {"a.tmpl": {Data: []byte("{{ .ProjectName \n")}},
+		"same path":     {"a.tmpl": {Data: []byte("x\n")}, "a": {Data: []byte("y\n")}},
+		"include mode":  {"a.yml.tmpl": {Data: []byte("---\nmode: include\n---\ninclude: a.yml\n")}},
+		"delete body":   {"a.tmpl": {Data: []byte("---\nmode: delete\n---\nx\n")}},
+		"same markers":  {"a.tmpl": {Data: []byte("---\nmode: block\nmarkers:\n  begin: \"#\"\n  end: \"#\"\n---\nx\n")}},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(fsys, &render.Engine{}, nil); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestBlockMode(t *testing.T) {
+	fsys := fstest.MapFS{
+		"README.md.tmpl": {Data: []byte("---\nmode: block\n---\nBuilt by {{ .ProjectName }}\n")},
+		".gitignore.tmpl": {Data: []byte(`---
+mode: block
+markers:
+  begin: "# gitlab-vault {"
+  end: "# gitlab-vault }"
+---
+.vault-token
+`)},
+	}
+	set, err := Load(fsys, &render.Engine{}, nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	files, err := set.Files(context.Background(), &gitlab.GitlabResp{ProjectName: "api"})
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	if len(files) != 2 || files[0].Merge == nil || files[1].Merge == nil {
+		t.Fatalf("Expected two block files, got %+v", files)
+	}
+
+	got, err := files[0].Merge("node_modules/\n# gitlab-vault {\nold\n# gitlab-vault }\n*.log\n")
+	if want := "node_modules/\n# gitlab-vault {\n.vault-token\n# gitlab-vault }\n*.log\n"; err != nil || got != want {
+		t.Errorf("Expected %q, got %q, %v", want, got, err)
+	}
+	got, err = files[1].Merge("# api\n")
+	if want := "# api\n\n<!-- BEGIN gitlab-vault managed block, do not edit -->\nBuilt by api\n<!-- END gitlab-vault managed block -->\n"; err != nil || got != want {
+		t.Errorf("Expected %q, got %q, %v", want, got, err)
+	}
+}
+
+func TestIncludeMode(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitlab-ci.yml.tmpl": {Data: []byte("---\nmode: include\n---\ninclude:\n  - project: ci/{{ .Zone }}\n    file: common.yml\n")},
+	}
+	set, err := Load(fsys, &render.Engine{Zone: "production"}, nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	ci, ok, err := set.Ci(context.Background(), &gitlab.GitlabResp{ProjectName: "api"})
+	if err != nil || !ok || ci.Merge == nil {
+		t.Fatalf("Expected an include CI file, got %+v, %v", ci, err)
+	}
+	got, err := ci.Merge("build:\n  script: make\n")
+	want := "include:\n  - project: ci/production\n    file: common.yml\n\nbuild:\n  script: make\n"
+	if err != nil || got != want {
+		t.Errorf("Expected %q, got %q, %v", want, got, err)
+	}
+}
+
+func TestDeleteMode(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitlab/old.yml.tmpl": {Data: []byte("---\nmode: delete\nwhen:\n  topics: [\"go\"]\n---\n")},
+		".gitlab-ci.yml.tmpl":  {Data: []byte("---\nmode: delete\n---\n")},
+	}
+	set, err := Load(fsys, &render.Engine{}, nil)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	set.CiPath = func(gr *gitlab.GitlabResp) (string, error) { return "ci/pipeline.yml", nil }
+
+	files, err := set.Files(context.Background(), &gitlab.GitlabResp{ProjectName: "api", Topics: []string{"go"}})
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	want := []gitlab.File{
+		{Path: "ci/pipeline.yml", Delete: true},
+		{Path: ".gitlab/old.yml", Delete: true},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected files:\n%+v\ngot:\n%+v", want, files)
+	}
+
+	files, err = set.Files(context.Background(), &gitlab.GitlabResp{ProjectName: "web"})
+	if err != nil || len(files) != 1 || files[0].Path != "ci/pipeline.yml" {
+		t.Errorf("Expected only the CI file deleted, got %+v, %v", files, err)
+	}
+}
@@ -1,36 +1,108 @@
 package gitlab
 
 import (
-	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 
+	"github.com/hashicorp/go-retryablehttp"
 	gitlab "gitlab.com/gitlab-org/api/client-go"
+	"golang.org/x/time/rate"
 )
 
 type GitlabInfo struct {
 	Token    string
 	GitlabNs string
 	BaseURL  string
+	// IncludeSubgroups lists the projects of the subgroups of GitlabNs too,
+	// at any depth
+	IncludeSubgroups bool
+	// BranchOverride and CiConfigPathOverride replace the default branch
+	// and the ci_config_path of every project when set
+	BranchOverride       string
+	CiConfigPathOverride string
+	// RequestsPerSecond caps the calls of all the workers together, zero
+	// follows the RateLimit-Limit header gitlab sends
+	RequestsPerSecond float64
+	// Delivery is DeliveryPush, the default, or DeliveryMergeRequest
+	Delivery     string
+	MergeRequest MergeRequestOptions
+	Commit       CommitOptions
+
+	// client is created by the first Initgitlab and shared by all callers
+	mu     sync.Mutex
+	client *GitlabClient
+	// assignees are the ids of MergeRequest.Assignees
+	assigneesOnce sync.Once
+	assignees     []int
+	assigneesErr  error
 }
 type GitlabVariable struct {
-	Key   string
-	Value string
+	Key       string
+	Value     string
+	Masked    bool
+	Protected bool
+	// EnvironmentScope defaults to "*" on the gitlab side
+	EnvironmentScope string
+	Description      string
 }
 
 type GitlabResp struct {
 	ProjectName string
 	ProjectId   string
+	// ProjectPath is the full path of the project, e.g. my-group/sub/app,
+	// and NamespacePath the full path of its group
+	ProjectPath   string
+	NamespacePath string
+	// DefaultBranch is empty for empty repositories, CiConfigPath when the
+	// project uses the gitlab default
+	DefaultBranch string
+	CiConfigPath  string
+	// the attributes the project selection filters on
+	Topics     []string
+	Visibility string
+	Fork       bool
+	Mirror     bool
+	EmptyRepo  bool
+}
+
+// Expand replaces {{project}} with the full path of the project, unlike its
+// name it is unique and has no spaces, and {{project_id}} with its id
+func (gr *GitlabResp) Expand(s string) string {
+	return strings.NewReplacer("{{project}}", gr.ProjectPath, "{{project_id}}", gr.ProjectId).Replace(s)
+}
+
+// Path is the full path of the project, its name when the path is unknown
+func (gr *GitlabResp) Path() string {
+	if gr.ProjectPath != "" {
+		return gr.ProjectPath
+	}
+	return gr.ProjectName
 }
 
 type GitlabClient struct {
 	*gitlab.Client
 }
 
+// maxIdleConns is the size of the connection pool to gitlab, it is shared by
+// all the workers
+const maxIdleConns = 64
+
+// Initgitlab returns the client shared by every GitlabInfo method, it is
+// created on the first call and safe for concurrent use
 func (g *GitlabInfo) Initgitlab(ctx context.Context) (*GitlabClient, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.client != nil {
+		return g.client, nil
+	}
+
 	if g.Token == "" {
 		return nil, errors.New("token cannot be empty")
 	}
@@ -40,17 +112,75 @@ func (g *GitlabInfo) Initgitlab(ctx context.Context) (*GitlabClient, error) {
 		baseURL = "http://127.0.1:8080/api/v4"
 	}
 
-	client, err := gitlab.NewClient(g.Token, gitlab.WithBaseURL(baseURL))
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+
+	options := []gitlab.ClientOptionFunc{
+		gitlab.WithBaseURL(baseURL),
+		gitlab.WithHTTPClient(&http.Client{Transport: transport}),
+		gitlab.WithCustomBackoff(retryAfterBackoff),
+	}
+	if g.RequestsPerSecond > 0 {
+		burst := max(1, int(g.RequestsPerSecond))
+		options = append(options, gitlab.WithCustomLimiter(rate.NewLimiter(rate.Limit(g.RequestsPerSecond), burst)))
+	}
+	client, err := gitlab.NewClient(g.Token, options...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &GitlabClient{
+	g.client = &GitlabClient{
 		Client: client,
-	}, nil
+	}
+	return g.client, nil
+}
+
+// retryAfterBackoff waits as long as a 429 response asks with Retry-After or
+// RateLimit-Reset, doubling min when it has neither. Server errors are
+// retried after a short linear backoff.
+func retryAfterBackoff(min, max time.Duration, attempt int, resp *http.Response) time.Duration {
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		return retryablehttp.LinearJitterBackoff(700*time.Millisecond, 900*time.Millisecond, attempt, resp)
+	}
+	if wait, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+		return wait
+	}
+	if reset, _ := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); reset > 0 {
+		if wait := time.Until(time.Unix(reset, 0)); wait > min {
+			return wait
+		}
+		return min
+	}
+	return min << attempt
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an http date
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
 }
 
 func (g *GitlabInfo) ListProject(ctx context.Context) ([]*GitlabResp, error) {
+	return g.listProjects(ctx, gitlab.Ptr(false))
+}
+
+// ListAllProjects lists the projects of the namespace, archived included
+func (g *GitlabInfo) ListAllProjects(ctx context.Context) ([]*GitlabResp, error) {
+	return g.listProjects(ctx, nil)
+}
+
+// listProjects lists the projects of the namespace, only the archived or the
+// unarchived ones when archived is set
+func (g *GitlabInfo) listProjects(ctx context.Context, archived *bool) ([]*GitlabResp, error) {
 	respList := []*GitlabResp{}
 
 	git, err := g.Initgitlab(ctx)
@@ -58,97 +188,388 @@ func (g *GitlabInfo) ListProject(ctx context.Context) ([]*GitlabResp, error) {
 		return []*GitlabResp{}, err
 	}
 
-	projList, _, err := git.Groups.ListGroupProjects(g.GitlabNs, &gitlab.ListGroupProjectsOptions{
-		Archived: gitlab.Ptr(false),
-	})
-	if err != nil {
-		return []*GitlabResp{}, err
+	opt := &gitlab.ListGroupProjectsOptions{
+		ListOptions:      gitlab.ListOptions{PerPage: 100, Page: 1},
+		Archived:         archived,
+		IncludeSubGroups: gitlab.Ptr(g.IncludeSubgroups),
 	}
+	for {
+		projList, resp, err := git.Groups.ListGroupProjects(g.GitlabNs, opt, gitlab.WithContext(ctx))
+		if err != nil {
+			return []*GitlabResp{}, err
+		}
 
-	for _, repo := range projList {
-		resp := &GitlabResp{
-			ProjectName: repo.Name,
-			ProjectId:   strconv.Itoa(repo.ID),
+		for _, repo := range projList {
+			resp := &GitlabResp{
+				ProjectName:   repo.Name,
+				ProjectId:     strconv.Itoa(repo.ID),
+				ProjectPath:   repo.PathWithNamespace,
+				DefaultBranch: repo.DefaultBranch,
+				CiConfigPath:  repo.CIConfigPath,
+				Topics:        repo.Topics,
+				Visibility:    string(repo.Visibility),
+				Fork:          repo.ForkedFromProject != nil,
+				Mirror:        repo.Mirror,
+				EmptyRepo:     repo.EmptyRepo,
+			}
+			if repo.Namespace != nil {
+				resp.NamespacePath = repo.Namespace.FullPath
+			}
+			respList = append(respList, resp)
 		}
-		respList = append(respList, resp)
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
 	}
 
 	return respList, nil
 }
 
-func (g *GitlabInfo) AddGitlabCiFile(ctx context.Context, gr *GitlabResp, content string) error {
+// ListProjectLabels returns the label names of the project, group labels
+// included
+func (g *GitlabInfo) ListProjectLabels(ctx context.Context, gr *GitlabResp) ([]string, error) {
 	git, err := g.Initgitlab(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if exists, _ := g.CheckFileExists(ctx, gr, ".gitlab-ci.yaml"); !exists {
-		_, _, err = git.RepositoryFiles.CreateFile(gr.ProjectId, ".gitlab-ci.yaml", &gitlab.CreateFileOptions{
-			Branch:        gitlab.Ptr("main"),
-			CommitMessage: gitlab.Ptr("Add .gitlab-ci.yaml"),
-			Content:       gitlab.Ptr(content),
-		})
-	} else {
-		_, _, err = git.RepositoryFiles.UpdateFile(gr.ProjectId, ".gitlab-ci.yaml", &gitlab.UpdateFileOptions{
-			Branch:        gitlab.Ptr("main"),
-			CommitMessage: gitlab.Ptr("Update .gitlab-ci.yaml"),
-			Content:       gitlab.Ptr(content),
-		})
+
+	names := []string{}
+	opt := &gitlab.ListLabelsOptions{
+		ListOptions:           gitlab.ListOptions{PerPage: 100, Page: 1},
+		IncludeAncestorGroups: gitlab.Ptr(true),
+	}
+	for {
+		page, resp, err := git.Labels.ListLabels(gr.ProjectId, opt, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range page {
+			names = append(names, l.Name)
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return names, nil
+}
+
+// DefaultCiConfigPath is the CI file gitlab reads when the project sets none
+const DefaultCiConfigPath = ".gitlab-ci.yml"
+
+// Branch is the branch the files of the project are written to: the zone
+// override, else the project default branch, else main for repositories
+// without one yet
+func (g *GitlabInfo) Branch(gr *GitlabResp) string {
+	if g.BranchOverride != "" {
+		return g.BranchOverride
 	}
+	if gr.DefaultBranch != "" {
+		return gr.DefaultBranch
+	}
+	return "main"
+}
+
+// CiConfigPath is the CI file of the project: the zone override, else the
+// project ci_config_path, else DefaultCiConfigPath. A path in another
+// project or at an url cannot be written and returns an error.
+func (g *GitlabInfo) CiConfigPath(gr *GitlabResp) (string, error) {
+	path := g.CiConfigPathOverride
+	if path == "" {
+		path = gr.CiConfigPath
+	}
+	if path == "" {
+		return DefaultCiConfigPath, nil
+	}
+	if strings.Contains(path, "@") || strings.Contains(path, "://") {
+		return "", fmt.Errorf("the CI config of project %s is outside the repository: %s", gr.ProjectName, path)
+	}
+	return strings.TrimPrefix(path, "/"), nil
+}
+
+// File is a managed file of a project, Delete removes it when it exists
+// and CreateOnly leaves it as it is once it exists. Merge, when set, writes
+// what it returns from the current content, empty for a missing file,
+// instead of Content.
+type File struct {
+	Path       string
+	Content    string
+	Delete     bool
+	CreateOnly bool
+	Merge      func(current string) (string, error)
+}
+
+// CommitOptions sets the commit of the managed files, gitlab uses the token
+// user as author when AuthorName and AuthorEmail are empty
+type CommitOptions struct {
+	// Message defaults to the action and the paths of the files
+	Message     string `koanf:"message"`
+	AuthorName  string `koanf:"author_name"`
+	AuthorEmail string `koanf:"author_email"`
+}
+
+// CiFile is the CI file of the project with content
+func (g *GitlabInfo) CiFile(gr *GitlabResp, content string) (File, error) {
+	path, err := g.CiConfigPath(gr)
 	if err != nil {
-		return err
+		return File{}, err
 	}
+	return File{Path: path, Content: content}, nil
+}
 
-	return nil
+// LintResult is the verdict of the gitlab CI lint on a CI file
+type LintResult struct {
+	Valid    bool
+	Errors   []string
+	Warnings []string
 }
 
-func (g *GitlabInfo) AddGitlabReadmeFile(ctx context.Context, gr *GitlabResp, content string) error {
+// LintCi validates the CI file content with the CI lint of the project,
+// includes are resolved on the branch the files are written to
+func (g *GitlabInfo) LintCi(ctx context.Context, gr *GitlabResp, content string) (*LintResult, error) {
 	git, err := g.Initgitlab(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	opt := &gitlab.ProjectNamespaceLintOptions{Content: gitlab.Ptr(content)}
+	if !gr.EmptyRepo {
+		opt.Ref = gitlab.Ptr(g.Branch(gr))
+	}
+	lint, _, err := git.Validate.ProjectNamespaceLint(gr.ProjectId, opt, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
 	}
-	tpl, err := template.New("readme").Parse(content)
+
+	return &LintResult{Valid: lint.Valid, Errors: lint.Errors, Warnings: lint.Warnings}, nil
+}
+
+func (g *GitlabInfo) AddGitlabCiFile(ctx context.Context, gr *GitlabResp, content string) error {
+	f, err := g.CiFile(gr, content)
 	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
-	err = tpl.Execute(&buf, map[string]interface{}{
-		"ProjectName": gr.ProjectName,
-	})
+	state, err := g.Branches(ctx, gr)
 	if err != nil {
 		return err
 	}
-	if exists, _ := g.CheckFileExists(ctx, gr, "README.md"); !exists {
-		_, _, err = git.RepositoryFiles.CreateFile(gr.ProjectId, "README.md", &gitlab.CreateFileOptions{
-			Branch:        gitlab.Ptr("main"),
-			CommitMessage: gitlab.Ptr("Add README.md"),
-			Content:       gitlab.Ptr(buf.String()),
-		})
-	} else {
-		_, _, err = git.RepositoryFiles.UpdateFile(gr.ProjectId, "README.md", &gitlab.UpdateFileOptions{
-			Branch:        gitlab.Ptr("main"),
-			CommitMessage: gitlab.Ptr("Update README.md"),
-			Content:       gitlab.Ptr(buf.String()),
-		})
+	_, err = g.CommitFiles(ctx, gr, state, []File{f})
+	return err
+}
+
+// Statuses of a file after CommitFiles
+const (
+	FileCreated   = "created"
+	FileUpdated   = "updated"
+	FileDeleted   = "deleted"
+	FileUnchanged = "unchanged"
+)
+
+// FileResult is a file after CommitFiles
+type FileResult struct {
+	Path   string
+	Status string
+}
+
+// FilePlan is what CommitFiles does with a file, Before is empty for
+// missing files and After for deleted ones
+type FilePlan struct {
+	FileResult
+	Before string
+	After  string
+}
+
+// PlanFiles compares the files with the ones CommitFiles would change,
+// without changing anything: on the merge request branch while its merge
+// request is open, else on the branch of the project. Files with the same
+// content, create only files that exist and deleted files that do not exist
+// are unchanged.
+func (g *GitlabInfo) PlanFiles(ctx context.Context, gr *GitlabResp, files []File) ([]FilePlan, error) {
+	state, err := g.Branches(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+	return g.planFiles(ctx, gr, state.read, files)
+}
+
+// planFiles compares the files with the ones on ref
+func (g *GitlabInfo) planFiles(ctx context.Context, gr *GitlabResp, ref string, files []File) ([]FilePlan, error) {
+	plans := []FilePlan{}
+	for _, f := range files {
+		var current *gitlab.File
+		var err error
+		if !gr.EmptyRepo {
+			if current, err = g.getFile(ctx, gr, ref, f.Path); err != nil {
+				return nil, err
+			}
+		}
+		plan := FilePlan{FileResult: FileResult{Path: f.Path}}
+		if current != nil {
+			if plan.Before, err = decodeContent(current); err != nil {
+				return nil, fmt.Errorf("could not read %s: %v", f.Path, err)
+			}
+		}
+		switch {
+		case f.Delete:
+		case f.CreateOnly && current != nil:
+			plan.After = plan.Before
+		case f.Merge != nil:
+			if plan.After, err = f.Merge(plan.Before); err != nil {
+				return nil, fmt.Errorf("could not merge %s: %v", f.Path, err)
+			}
+		default:
+			plan.After = f.Content
+		}
+		switch {
+		case current == nil && f.Delete, current != nil && !f.Delete && plan.Before == plan.After:
+			plan.Status = FileUnchanged
+		case f.Delete:
+			plan.Status = FileDeleted
+		case current != nil:
+			plan.Status = FileUpdated
+		default:
+			plan.Status = FileCreated
+		}
+		plans = append(plans, plan)
+	}
+	return plans, nil
+}
+
+// decodeContent returns the content of a file read from gitlab
+func decodeContent(f *gitlab.File) (string, error) {
+	if f.Encoding != "base64" {
+		return f.Content, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(f.Content)
+	return string(decoded), err
+}
+
+// CommitFiles writes the files in a single commit on the branch of the
+// project, or on its merge request branch in merge request mode, as state
+// from Branches tells. Each file is created or updated depending on whether
+// it exists, files with the same content and deleted files that do not
+// exist are left out and reported unchanged. The first commit of an empty
+// repository creates the branch.
+func (g *GitlabInfo) CommitFiles(ctx context.Context, gr *GitlabResp, state *BranchState, files []File) ([]FileResult, error) {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return nil, err
 	}
+	branch := state.write
+
+	plans, err := g.planFiles(ctx, gr, state.read, files)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	results := []FileResult{}
+	actions := []*gitlab.CommitActionOptions{}
+	fileActions := map[string]gitlab.FileActionValue{
+		FileCreated: gitlab.FileCreate,
+		FileUpdated: gitlab.FileUpdate,
+		FileDeleted: gitlab.FileDelete,
+	}
+	verbs := map[string]string{
+		FileCreated: "Add",
+		FileUpdated: "Update",
+		FileDeleted: "Delete",
+	}
+	var verb string
+	paths := []string{}
+	for _, p := range plans {
+		results = append(results, p.FileResult)
+		if p.Status == FileUnchanged {
+			continue
+		}
+		action := &gitlab.CommitActionOptions{
+			Action:   gitlab.Ptr(fileActions[p.Status]),
+			FilePath: gitlab.Ptr(p.Path),
+		}
+		if p.Status != FileDeleted {
+			action.Content = gitlab.Ptr(p.After)
+		}
+		// mixed actions read as an update
+		if verb == "" {
+			verb = verbs[p.Status]
+		} else if verb != verbs[p.Status] {
+			verb = "Update"
+		}
+		actions = append(actions, action)
+		paths = append(paths, p.Path)
+	}
+	if len(actions) == 0 {
+		if state.stale {
+			// the target branch is up to date, the left over branch would
+			// only bring back its old changes
+			if _, err := git.Branches.DeleteBranch(gr.ProjectId, branch, gitlab.WithContext(ctx)); err != nil {
+				return nil, fmt.Errorf("could not delete the stale branch %s: %v", branch, err)
+			}
+			state.exists = false
+		}
+		return results, nil
+	}
+
+	opt := &gitlab.CreateCommitOptions{
+		Branch:        gitlab.Ptr(branch),
+		CommitMessage: gitlab.Ptr(verb + " " + strings.Join(paths, ", ")),
+		Actions:       actions,
+	}
+	if state.start != "" {
+		opt.StartBranch = gitlab.Ptr(state.start)
+		opt.Force = gitlab.Ptr(state.stale)
+	}
+	if g.Commit.Message != "" {
+		opt.CommitMessage = gitlab.Ptr(g.Commit.Message)
+	}
+	if g.Commit.AuthorName != "" {
+		opt.AuthorName = gitlab.Ptr(g.Commit.AuthorName)
+	}
+	if g.Commit.AuthorEmail != "" {
+		opt.AuthorEmail = gitlab.Ptr(g.Commit.AuthorEmail)
+	}
+	if _, _, err = git.Commits.CreateCommit(gr.ProjectId, opt, gitlab.WithContext(ctx)); err != nil {
+		return nil, err
+	}
+	state.exists = true
+
+	if gr.EmptyRepo {
+		// the commit created the branch, gitlab makes it the default one
+		gr.EmptyRepo = false
+		gr.DefaultBranch = branch
+	}
+	return results, nil
 }
+
+// CheckFileExists looks for the file on the branch of the project, a missing
+// file is not an error
 func (g *GitlabInfo) CheckFileExists(ctx context.Context, gr *GitlabResp, filePath string) (bool, error) {
-	git, err := g.Initgitlab(ctx)
+	f, err := g.getFile(ctx, gr, g.Branch(gr), filePath)
 	if err != nil {
 		return false, err
 	}
-	_, _, err = git.RepositoryFiles.GetFile(gr.ProjectId, filePath, &gitlab.GetFileOptions{
-		Ref: gitlab.Ptr("main"),
-	})
+	return f != nil, nil
+}
+
+// getFile returns the file on ref, nil when it is missing
+func (g *GitlabInfo) getFile(ctx context.Context, gr *GitlabResp, ref, filePath string) (*gitlab.File, error) {
+	git, err := g.Initgitlab(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	f, resp, err := git.RepositoryFiles.GetFile(gr.ProjectId, filePath, &gitlab.GetFileOptions{
+		Ref: gitlab.Ptr(ref),
+	}, gitlab.WithContext(ctx))
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return true, nil
+	return f, nil
 }
 
 func (g *GitlabInfo) ListVariables(ctx context.Context, gr *GitlabResp) ([]*gitlab.ProjectVariable, error) {
@@ -157,9 +578,18 @@ func (g *GitlabInfo) ListVariables(ctx context.Context, gr *GitlabResp) ([]*gitl
 		return nil, err
 	}
 
-	vars, _, err := git.ProjectVariables.ListVariables(gr.ProjectId, &gitlab.ListProjectVariablesOptions{})
-	if err != nil {
-		return nil, err
+	vars := []*gitlab.ProjectVariable{}
+	opt := &gitlab.ListProjectVariablesOptions{PerPage: 100, Page: 1}
+	for {
+		page, resp, err := git.ProjectVariables.ListVariables(gr.ProjectId, opt, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
 	}
 
 	return vars, nil
@@ -171,11 +601,19 @@ func (g *GitlabInfo) CreateVariable(ctx context.Context, gr *GitlabResp, v *Gitl
 		return err
 	}
 
-	_, _, err = git.ProjectVariables.CreateVariable(gr.ProjectId, &gitlab.CreateProjectVariableOptions{
+	opt := &gitlab.CreateProjectVariableOptions{
 		Key:       &v.Key,
 		Value:     &v.Value,
-		Protected: gitlab.Ptr(false),
-	})
+		Masked:    gitlab.Ptr(v.Masked),
+		Protected: gitlab.Ptr(v.Protected),
+	}
+	if v.EnvironmentScope != "" {
+		opt.EnvironmentScope = &v.EnvironmentScope
+	}
+	if v.Description != "" {
+		opt.Description = &v.Description
+	}
+	_, _, err = git.ProjectVariables.CreateVariable(gr.ProjectId, opt, gitlab.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -183,34 +621,152 @@ func (g *GitlabInfo) CreateVariable(ctx context.Context, gr *GitlabResp, v *Gitl
 	return nil
 }
 
-func (g *GitlabInfo) UpdateVariable(ctx context.Context, gr *GitlabResp, variable *gitlab.ProjectVariable) error {
+// UpdateVariableValue sets the value and flags of an existing variable
+func (g *GitlabInfo) UpdateVariableValue(ctx context.Context, gr *GitlabResp, v *GitlabVariable) error {
 	git, err := g.Initgitlab(ctx)
 	if err != nil {
 		return err
 	}
-	// TODO: Check variable type and if file concatenate content
 
-	switch variable.VariableType {
-	case gitlab.FileVariableType:
-		// compute
-		// get the file content and parse it
-		content := strings.Split(variable.Value, ":")
-		content = append(content, gr.ProjectId)
+	opt := &gitlab.UpdateProjectVariableOptions{
+		Value:     &v.Value,
+		Masked:    gitlab.Ptr(v.Masked),
+		Protected: gitlab.Ptr(v.Protected),
+	}
+	if v.EnvironmentScope != "" {
+		opt.Filter = &gitlab.VariableFilter{EnvironmentScope: v.EnvironmentScope}
+	}
+	if v.Description != "" {
+		opt.Description = &v.Description
+	}
+	_, _, err = git.ProjectVariables.UpdateVariable(gr.ProjectId, v.Key, opt, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
 
-		updateedVal := strings.Join(content, ":")
-		_, _, err = git.ProjectVariables.UpdateVariable(gr.ProjectId, variable.Key, &gitlab.UpdateProjectVariableOptions{
-			Value: &updateedVal,
-		})
+	return nil
+}
+
+func (g *GitlabInfo) DeleteVariable(ctx context.Context, gr *GitlabResp, key, environmentScope string) error {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return err
+	}
+
+	opt := &gitlab.RemoveProjectVariableOptions{}
+	if environmentScope != "" {
+		opt.Filter = &gitlab.VariableFilter{EnvironmentScope: environmentScope}
+	}
+	_, err = git.ProjectVariables.RemoveVariable(gr.ProjectId, key, opt, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (g *GitlabInfo) ListDeployKeys(ctx context.Context, gr *GitlabResp) ([]*gitlab.ProjectDeployKey, error) {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*gitlab.ProjectDeployKey{}
+	opt := &gitlab.ListProjectDeployKeysOptions{PerPage: 100, Page: 1}
+	for {
+		page, resp, err := git.DeployKeys.ListProjectDeployKeys(gr.ProjectId, opt, gitlab.WithContext(ctx))
 		if err != nil {
-			return err
+			return nil, err
 		}
-	default:
-		_, _, err = git.ProjectVariables.UpdateVariable(gr.ProjectId, variable.Key, &gitlab.UpdateProjectVariableOptions{
-			Value: &gr.ProjectId,
-		})
-		if err != nil {
-			return err
+		keys = append(keys, page...)
+		if resp.NextPage == 0 {
+			break
 		}
+		opt.Page = resp.NextPage
+	}
+
+	return keys, nil
+}
+
+// AddDeployKey registers a public key on the project and returns its id
+func (g *GitlabInfo) AddDeployKey(ctx context.Context, gr *GitlabResp, title, key string, canPush bool) (int, error) {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	dk, _, err := git.DeployKeys.AddDeployKey(gr.ProjectId, &gitlab.AddDeployKeyOptions{
+		Title:   &title,
+		Key:     &key,
+		CanPush: gitlab.Ptr(canPush),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	return dk.ID, nil
+}
+
+func (g *GitlabInfo) DeleteDeployKey(ctx context.Context, gr *GitlabResp, id int) error {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = git.DeployKeys.DeleteDeployKey(gr.ProjectId, id, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// LegacyValue is the value UpdateVariable gives the variable: the project
+// id, appended to the value of file variables
+func LegacyValue(gr *GitlabResp, variable *gitlab.ProjectVariable) string {
+	if variable.VariableType == gitlab.FileVariableType {
+		content := strings.Split(variable.Value, ":")
+		content = append(content, gr.ProjectId)
+		return strings.Join(content, ":")
+	}
+	return gr.ProjectId
+}
+
+// LegacyPlan is a variable with the value UpdateVariable gives it
+type LegacyPlan struct {
+	Key              string
+	EnvironmentScope string
+	Before           string
+	After            string
+}
+
+// PlanLegacy returns the values UpdateVariable would give the variables
+func PlanLegacy(gr *GitlabResp, vars []*gitlab.ProjectVariable) []LegacyPlan {
+	plans := []LegacyPlan{}
+	for _, v := range vars {
+		plans = append(plans, LegacyPlan{
+			Key:              v.Key,
+			EnvironmentScope: v.EnvironmentScope,
+			Before:           v.Value,
+			After:            LegacyValue(gr, v),
+		})
+	}
+	return plans
+}
+
+func (g *GitlabInfo) UpdateVariable(ctx context.Context, gr *GitlabResp, variable *gitlab.ProjectVariable) error {
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return err
+	}
+	// TODO: Check variable type and if file concatenate content
+
+	value := LegacyValue(gr, variable)
+	_, _, err = git.ProjectVariables.UpdateVariable(gr.ProjectId, variable.Key, &gitlab.UpdateProjectVariableOptions{
+		Value: &value,
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
 	}
 
 	return nil
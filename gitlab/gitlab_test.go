@@ -1,11 +1,25 @@
 package gitlab
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	gitlab "gitlab.com/gitlab-org/api/client-go"
 )
 
 func setupMockGitLabServer() (*httptest.Server, func()) {
@@ -22,7 +36,7 @@ func setupMockGitLabServer() (*httptest.Server, func()) {
 	})
 
 	// Mock projects endpoint
-	mux.HandleFunc("/api/v4/projects", func(w http.ResponseWriter, r *http.Request) {
+	projectsHandler := func(w http.ResponseWriter, r *http.Request) {
 		token := r.Header.Get("PRIVATE-TOKEN")
 		if token != "valid-token" {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -41,7 +55,9 @@ func setupMockGitLabServer() (*httptest.Server, func()) {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(projects)
-	})
+	}
+	mux.HandleFunc("/api/v4/projects", projectsHandler)
+	mux.HandleFunc("/api/v4/groups/test-namespace/projects", projectsHandler)
 
 	server := httptest.NewServer(mux)
 	return server, server.Close
@@ -128,7 +144,7 @@ func TestListProject(t *testing.T) {
 				GitlabNs: tt.namespace,
 				BaseURL:  server.URL + "/api/v4",
 			}
-			projects, err := g.ListProject()
+			projects, err := g.ListProject(context.Background())
 			if tt.wantErr {
 				if err == nil {
 					t.Error("Expected error but got none")
@@ -156,6 +172,880 @@ func TestListProject(t *testing.T) {
 	}
 }
 
+// setupMockPagedProjects serves 250 projects of my-group by pages, and one
+// more of my-group/sub when subgroups are included
+func setupMockPagedProjects(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/groups/my-group/projects", func(w http.ResponseWriter, r *http.Request) {
+		projects := []map[string]interface{}{}
+		for i := 1; i <= 250; i++ {
+			projects = append(projects, map[string]interface{}{
+				"id":                  i,
+				"name":                fmt.Sprintf("app%d", i),
+				"path_with_namespace": fmt.Sprintf("my-group/app%d", i),
+				"namespace":           map[string]interface{}{"full_path": "my-group"},
+			})
+		}
+		if r.URL.Query().Get("include_subgroups") == "true" {
+			projects = append(projects, map[string]interface{}{
+				"id":                  1000,
+				"name":                "deep",
+				"path_with_namespace": "my-group/sub/deep",
+				"namespace":           map[string]interface{}{"full_path": "my-group/sub"},
+			})
+		}
+
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		start := (page - 1) * perPage
+		end := min(start+perPage, len(projects))
+		if end < len(projects) {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(projects[start:end])
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestListProjectPages(t *testing.T) {
+	server := setupMockPagedProjects(t)
+
+	tests := []struct {
+		name      string
+		subgroups bool
+		wantCount int
+	}{
+		{name: "group only", wantCount: 250},
+		{name: "with subgroups", subgroups: true, wantCount: 251},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &GitlabInfo{
+				Token:            "valid-token",
+				GitlabNs:         "my-group",
+				BaseURL:          server.URL + "/api/v4",
+				IncludeSubgroups: tt.subgroups,
+			}
+			projects, err := g.ListProject(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(projects) != tt.wantCount {
+				t.Fatalf("Expected %d projects but got %d", tt.wantCount, len(projects))
+			}
+			if p := projects[249]; p.ProjectPath != "my-group/app250" || p.NamespacePath != "my-group" {
+				t.Errorf("Expected the path of app250, got %q in %q", p.ProjectPath, p.NamespacePath)
+			}
+			if tt.subgroups {
+				if p := projects[250]; p.ProjectPath != "my-group/sub/deep" || p.NamespacePath != "my-group/sub" {
+					t.Errorf("Expected the subgroup project, got %q in %q", p.ProjectPath, p.NamespacePath)
+				}
+			}
+		})
+	}
+}
+
+func TestListAllProjects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/groups/my-group/projects", func(w http.ResponseWriter, r *http.Request) {
+		projects := []map[string]interface{}{{"id": 1, "name": "live"}}
+		if r.URL.Query().Get("archived") != "false" {
+			projects = append(projects, map[string]interface{}{"id": 2, "name": "old", "archived": true})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(projects)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	g := &GitlabInfo{Token: "valid-token", GitlabNs: "my-group", BaseURL: server.URL + "/api/v4"}
+	projects, err := g.ListProject(context.Background())
+	if err != nil || len(projects) != 1 {
+		t.Fatalf("Expected the unarchived project only, got %d projects, err %v", len(projects), err)
+	}
+	projects, err = g.ListAllProjects(context.Background())
+	if err != nil || len(projects) != 2 {
+		t.Fatalf("Expected the archived project too, got %d projects, err %v", len(projects), err)
+	}
+}
+
+func TestInitgitlabShared(t *testing.T) {
+	server, cleanup := setupMockGitLabServer()
+	defer cleanup()
+
+	g := &GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"}
+	clients := make(chan *GitlabClient, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, err := g.Initgitlab(context.Background())
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			clients <- client
+		}()
+	}
+	wg.Wait()
+	close(clients)
+
+	first := <-clients
+	for client := range clients {
+		if client != first {
+			t.Fatal("Expected every caller to get the same client")
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/groups/my-group/projects", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 1, "name": "app"}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	g := &GitlabInfo{Token: "valid-token", GitlabNs: "my-group", BaseURL: server.URL + "/api/v4"}
+	start := time.Now()
+	projects, err := g.ListProject(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(projects) != 1 || calls.Load() != 2 {
+		t.Fatalf("Expected one project after a retry, got %d projects in %d calls", len(projects), calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the retry to wait for Retry-After, waited %s", elapsed)
+	}
+}
+
+func TestRetryAfterBackoff(t *testing.T) {
+	date := time.Now().Add(3 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		name     string
+		header   string
+		min, max time.Duration
+	}{
+		{name: "seconds", header: "5", min: 5 * time.Second, max: 5 * time.Second},
+		{name: "http date", header: date, min: time.Second, max: 3 * time.Second},
+		{name: "missing", min: 400 * time.Millisecond, max: 400 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			wait := retryAfterBackoff(100*time.Millisecond, 400*time.Millisecond, 2, resp)
+			if wait < tt.min || wait > tt.max {
+				t.Errorf("Expected a wait between %s and %s, got %s", tt.min, tt.max, wait)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	server, cleanup := setupMockGitLabServer()
+	defer cleanup()
+
+	g := &GitlabInfo{
+		Token:             "valid-token",
+		GitlabNs:          "test-namespace",
+		BaseURL:           server.URL + "/api/v4",
+		RequestsPerSecond: 10,
+	}
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		if _, err := g.ListProject(context.Background()); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// a burst of 10 then one call every 100ms
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Expected the limiter to spread the calls, took %s", elapsed)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	server, cleanup := setupMockGitLabServer()
+	defer cleanup()
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	tests := []struct {
+		name string
+		g    *GitlabInfo
+	}{
+		// the first call takes the only token, the next waits 10s
+		{"limiter", &GitlabInfo{Token: "valid-token", GitlabNs: "test-namespace", BaseURL: server.URL + "/api/v4", RequestsPerSecond: 0.1}},
+		{"retry backoff", &GitlabInfo{Token: "valid-token", GitlabNs: "test-namespace", BaseURL: limited.URL + "/api/v4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.g.RequestsPerSecond > 0 {
+				if _, err := tt.g.ListProject(context.Background()); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			if _, err := tt.g.ListProject(ctx); err == nil {
+				t.Fatal("Expected an error once the context is cancelled")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("Expected the call to stop with the context, took %s", elapsed)
+			}
+		})
+	}
+}
+
+// branches returns where CommitFiles writes the files of gr
+func branches(t *testing.T, g *GitlabInfo, gr *GitlabResp) *BranchState {
+	t.Helper()
+	state, err := g.Branches(context.Background(), gr)
+	if err != nil {
+		t.Fatalf("Branches: %v", err)
+	}
+	return state
+}
+
+// setupMockFiles serves the repository files of project 1 and records the
+// writes with their branch
+func setupMockFiles(t *testing.T, files map[string]string) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	writes := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", mockGetFile(&mu, files))
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", mockCommits(&mu, files, func(format string, a ...interface{}) {
+		writes = append(writes, fmt.Sprintf(format, a...))
+	}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &writes
+}
+
+// mockGetFile serves the files of project 1, keyed by <ref>:<path>
+func mockGetFile(mu *sync.Mutex, files map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		path := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/repository/files/")
+		w.Header().Set("Content-Type", "application/json")
+		content, ok := files[r.URL.Query().Get("ref")+":"+path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"404 File Not Found"}`))
+			return
+		}
+		sum := sha256.Sum256([]byte(content))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"file_path":      path,
+			"encoding":       "base64",
+			"content":        base64.StdEncoding.EncodeToString([]byte(content)),
+			"content_sha256": hex.EncodeToString(sum[:]),
+		})
+	}
+}
+
+// mockCommits applies the commit actions to files and records each one as
+// "<action> <path> on <branch>"
+func mockCommits(mu *sync.Mutex, files map[string]string, record func(format string, a ...interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var body struct {
+			Branch  string `json:"branch"`
+			Actions []struct {
+				Action   string `json:"action"`
+				FilePath string `json:"file_path"`
+				Content  string `json:"content"`
+			} `json:"actions"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, a := range body.Actions {
+			if a.Action == "delete" {
+				delete(files, body.Branch+":"+a.FilePath)
+			} else {
+				files[body.Branch+":"+a.FilePath] = a.Content
+			}
+			record("%s %s on %s", a.Action, a.FilePath, body.Branch)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "0123abcd"})
+	}
+}
+
+func TestAddFilesBranchAndPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		project    GitlabResp
+		branch     string
+		ciPath     string
+		files      map[string]string
+		wantWrites []string
+		wantErr    bool
+	}{
+		{
+			name:    "project settings",
+			project: GitlabResp{DefaultBranch: "develop", CiConfigPath: "ci/pipeline.yml"},
+			files:   map[string]string{"develop:ci/pipeline.yml": "include: old\n"},
+			wantWrites: []string{
+				"update ci/pipeline.yml on develop",
+				"create README.md on develop",
+			},
+		},
+		{
+			name:    "gitlab defaults",
+			project: GitlabResp{DefaultBranch: "master"},
+			files:   map[string]string{},
+			wantWrites: []string{
+				"create .gitlab-ci.yml on master",
+				"create README.md on master",
+			},
+		},
+		{
+			name:    "zone overrides",
+			project: GitlabResp{DefaultBranch: "develop", CiConfigPath: "ci/pipeline.yml"},
+			branch:  "gitops",
+			ciPath:  ".gitlab/ci.yml",
+			files:   map[string]string{"gitops:README.md": "# old\n"},
+			wantWrites: []string{
+				"create .gitlab/ci.yml on gitops",
+				"update README.md on gitops",
+			},
+		},
+		{
+			name:    "empty repository",
+			project: GitlabResp{EmptyRepo: true},
+			files:   map[string]string{},
+			wantWrites: []string{
+				"create .gitlab-ci.yml on main",
+				"create README.md on main",
+			},
+		},
+		{
+			name:    "external CI config",
+			project: GitlabResp{DefaultBranch: "main", CiConfigPath: "ci.yml@platform/pipelines"},
+			files:   map[string]string{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, writes := setupMockFiles(t, tt.files)
+			g := &GitlabInfo{
+				Token:                "valid-token",
+				BaseURL:              server.URL + "/api/v4",
+				BranchOverride:       tt.branch,
+				CiConfigPathOverride: tt.ciPath,
+			}
+			gr := tt.project
+			gr.ProjectId = "1"
+			gr.ProjectName = "app"
+
+			err := g.AddGitlabCiFile(context.Background(), &gr, "include: []\n")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("AddGitlabCiFile: %v", err)
+			}
+			if _, err := g.CommitFiles(context.Background(), &gr, branches(t, g, &gr), []File{{Path: "README.md", Content: "# app\n"}}); err != nil {
+				t.Fatalf("CommitFiles: %v", err)
+			}
+			if strings.Join(*writes, ",") != strings.Join(tt.wantWrites, ",") {
+				t.Errorf("Expected writes %v, got %v", tt.wantWrites, *writes)
+			}
+			if gr.EmptyRepo {
+				t.Error("Expected the repository to be initialized")
+			}
+		})
+	}
+}
+
+func TestCommitFiles(t *testing.T) {
+	var mu sync.Mutex
+	files := map[string]string{"main:README.md": "# app\n", "main:Makefile": "all:\n", "main:CODEOWNERS": "* @team\n", "main:old.yml": "x: 1\n", "main:NOTES.md": "team\n"}
+	commits := []map[string]interface{}{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", mockGetFile(&mu, files))
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		commits = append(commits, body)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "0123abcd"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	g := &GitlabInfo{
+		Token:   "valid-token",
+		BaseURL: server.URL + "/api/v4",
+		Commit: CommitOptions{
+			Message:     "chore: sync managed files",
+			AuthorName:  "gitlab-vault",
+			AuthorEmail: "gitlab-vault@example.com",
+		},
+	}
+	gr := &GitlabResp{ProjectId: "1", ProjectName: "app", DefaultBranch: "main"}
+	results, err := g.CommitFiles(context.Background(), gr, branches(t, g, gr), []File{
+		{Path: ".gitlab-ci.yml", Content: "include: []\n"},
+		{Path: "README.md", Content: "# app\n"},
+		{Path: "Makefile", Content: "all: build\n"},
+		{Path: "CODEOWNERS", Content: "* @grp\n", CreateOnly: true},
+		{Path: "old.yml", Delete: true},
+		{Path: "missing.yml", Delete: true},
+		{Path: "NOTES.md", Merge: func(current string) (string, error) { return current + "managed\n", nil }},
+	})
+	if err != nil {
+		t.Fatalf("CommitFiles: %v", err)
+	}
+	if len(commits) != 1 {
+		t.Fatalf("Expected a single commit, got %d", len(commits))
+	}
+	wantResults := []FileResult{
+		{Path: ".gitlab-ci.yml", Status: FileCreated},
+		{Path: "README.md", Status: FileUnchanged},
+		{Path: "Makefile", Status: FileUpdated},
+		{Path: "CODEOWNERS", Status: FileUnchanged},
+		{Path: "old.yml", Status: FileDeleted},
+		{Path: "missing.yml", Status: FileUnchanged},
+		{Path: "NOTES.md", Status: FileUpdated},
+	}
+	if !reflect.DeepEqual(results, wantResults) {
+		t.Errorf("Expected results %v, got %v", wantResults, results)
+	}
+
+	c := commits[0]
+	if c["branch"] != "main" || c["commit_message"] != "chore: sync managed files" ||
+		c["author_name"] != "gitlab-vault" || c["author_email"] != "gitlab-vault@example.com" {
+		t.Errorf("Unexpected commit %v", c)
+	}
+	got := []string{}
+	for _, a := range c["actions"].([]interface{}) {
+		action := a.(map[string]interface{})
+		got = append(got, fmt.Sprintf("%s %s", action["action"], action["file_path"]))
+		if action["file_path"] == "NOTES.md" && action["content"] != "team\nmanaged\n" {
+			t.Errorf("Expected the merged NOTES.md, got %q", action["content"])
+		}
+	}
+	want := "create .gitlab-ci.yml,update Makefile,delete old.yml,update NOTES.md"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Expected actions %s, got %v", want, got)
+	}
+
+	// nothing to write, no commit
+	if _, err := g.CommitFiles(context.Background(), gr, branches(t, g, gr), []File{{Path: "README.md", Content: "# app\n"}, {Path: "missing.yml", Delete: true}}); err != nil {
+		t.Fatalf("CommitFiles: %v", err)
+	}
+	if len(commits) != 1 {
+		t.Errorf("Expected no commit without actions, got %d", len(commits))
+	}
+}
+
+func TestLintCi(t *testing.T) {
+	var ref string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/ci/lint", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		ref = fmt.Sprint(body["ref"])
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(fmt.Sprint(body["content"]), "script:") {
+			json.NewEncoder(w).Encode(map[string]interface{}{"valid": false, "errors": []string{"jobs config should contain at least one visible job"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"valid": true, "errors": []string{}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	g := &GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"}
+	gr := &GitlabResp{ProjectId: "1", DefaultBranch: "develop"}
+	result, err := g.LintCi(context.Background(), gr, "test:\n  script: go test\n")
+	if err != nil {
+		t.Fatalf("LintCi: %v", err)
+	}
+	if !result.Valid || ref != "develop" {
+		t.Errorf("Expected a valid config linted on develop, got %+v on %s", result, ref)
+	}
+
+	result, err = g.LintCi(context.Background(), gr, "include: []\n")
+	if err != nil {
+		t.Fatalf("LintCi: %v", err)
+	}
+	if result.Valid || len(result.Errors) != 1 {
+		t.Errorf("Expected an invalid config, got %+v", result)
+	}
+}
+
+// setupMockMergeRequests serves the files, branches, users and merge
+// requests of project 1 and records the writes
+func setupMockMergeRequests(t *testing.T) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	calls := []string{}
+	files := map[string]string{"main:README.md": "# old\n"}
+	branches := map[string]bool{"main": true}
+	mrs := []map[string]interface{}{}
+	merges := 0
+	record := func(format string, a ...interface{}) {
+		calls = append(calls, fmt.Sprintf(format, a...))
+	}
+	decode := func(r *http.Request) map[string]interface{} {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		return body
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", mockGetFile(&mu, files))
+	// branchFiles lists the files of a branch by name
+	branchFiles := func(branch string) map[string]string {
+		found := map[string]string{}
+		for f, content := range files {
+			if name, ok := strings.CutPrefix(f, branch+":"); ok {
+				found[name] = content
+			}
+		}
+		return found
+	}
+	commits := mockCommits(&mu, files, record)
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		var body struct {
+			Branch      string `json:"branch"`
+			StartBranch string `json:"start_branch"`
+			Force       bool   `json:"force"`
+		}
+		json.Unmarshal(raw, &body)
+		if body.StartBranch != "" {
+			mu.Lock()
+			if branches[body.Branch] && !body.Force {
+				mu.Unlock()
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"message":"A branch called this already exists"}`))
+				return
+			}
+			// the branch starts over from the start branch
+			for name := range branchFiles(body.Branch) {
+				delete(files, body.Branch+":"+name)
+			}
+			for name, content := range branchFiles(body.StartBranch) {
+				files[body.Branch+":"+name] = content
+			}
+			branches[body.Branch] = true
+			record("start %s from %s force=%v", body.Branch, body.StartBranch, body.Force)
+			mu.Unlock()
+		}
+		r.Body = io.NopCloser(bytes.NewReader(raw))
+		commits(w, r)
+	})
+	mux.HandleFunc("/api/v4/projects/1/repository/branches/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		branch := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/repository/branches/")
+		if r.Method == http.MethodGet {
+			record("read branch %s", branch)
+		}
+		if !branches[branch] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"404 Branch Not Found"}`))
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(branches, branch)
+			for name := range branchFiles(branch) {
+				delete(files, branch+":"+name)
+			}
+			record("delete branch %s", branch)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": branch})
+	})
+	mux.HandleFunc("/api/v4/projects/1/repository/compare", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		from, to := branchFiles(r.URL.Query().Get("from")), branchFiles(r.URL.Query().Get("to"))
+		diffs := []map[string]interface{}{}
+		for name, content := range to {
+			if c, ok := from[name]; !ok || c != content {
+				diffs = append(diffs, map[string]interface{}{"new_path": name})
+			}
+		}
+		for name := range from {
+			if _, ok := to[name]; !ok {
+				diffs = append(diffs, map[string]interface{}{"old_path": name, "deleted_file": true})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"diffs": diffs})
+	})
+	mux.HandleFunc("/api/v4/users", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		record("find user %s", r.URL.Query().Get("username"))
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 7, "username": r.URL.Query().Get("username")}})
+	})
+	mux.HandleFunc("/api/v4/projects/1/merge_requests", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodGet {
+			q := r.URL.Query()
+			open := []map[string]interface{}{}
+			for _, mr := range mrs {
+				if q.Get("state") == mr["state"] && mr["source_branch"] == q.Get("source_branch") && mr["target_branch"] == q.Get("target_branch") {
+					open = append(open, mr)
+				}
+			}
+			json.NewEncoder(w).Encode(open)
+			return
+		}
+		body := decode(r)
+		mr := map[string]interface{}{
+			"iid":           len(mrs) + 1,
+			"state":         "opened",
+			"source_branch": body["source_branch"],
+			"target_branch": body["target_branch"],
+			"web_url":       fmt.Sprintf("https://gitlab.example.com/app/-/merge_requests/%d", len(mrs)+1),
+		}
+		mrs = append(mrs, mr)
+		record("create merge request %v -> %v labels=%v assignees=%v", body["source_branch"], body["target_branch"], body["labels"], body["assignee_ids"])
+		json.NewEncoder(w).Encode(mr)
+	})
+	mux.HandleFunc("/api/v4/projects/1/merge_requests/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		rest := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/merge_requests/")
+		iid, _ := strconv.Atoi(strings.TrimSuffix(rest, "/merge"))
+		if iid < 1 || iid > len(mrs) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body := decode(r)
+		if strings.HasSuffix(rest, "/merge") {
+			merges++
+			if merges == 1 {
+				// gitlab is still checking the new merge request
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				w.Write([]byte(`{"message":"405 Method Not Allowed"}`))
+				return
+			}
+			record("merge !%d when pipeline succeeds=%v", iid, body["merge_when_pipeline_succeeds"])
+		} else if body["state_event"] == "close" {
+			mrs[iid-1]["state"] = "closed"
+			record("close merge request !%d", iid)
+		} else {
+			record("update merge request !%d add_labels=%v assignees=%v", iid, body["add_labels"], body["assignee_ids"])
+		}
+		json.NewEncoder(w).Encode(mrs[iid-1])
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestMergeRequestDelivery(t *testing.T) {
+	defer func(wait time.Duration) { autoMergeWait = wait }(autoMergeWait)
+	autoMergeWait = 0
+
+	server, calls := setupMockMergeRequests(t)
+	g := &GitlabInfo{
+		Token:    "valid-token",
+		BaseURL:  server.URL + "/api/v4",
+		Delivery: DeliveryMergeRequest,
+		MergeRequest: MergeRequestOptions{
+			Labels:    []string{"gitlab-vault"},
+			Assignees: []string{"alice"},
+			AutoMerge: true,
+		},
+	}
+	gr := &GitlabResp{ProjectId: "1", ProjectName: "app", DefaultBranch: "main"}
+
+	run := func() *MergeRequest {
+		t.Helper()
+		ctx := context.Background()
+		ci, _ := g.CiFile(gr, "include: []\n")
+		readme := File{Path: "README.md", Content: "# app\n"}
+		state := branches(t, g, gr)
+		if _, err := g.CommitFiles(ctx, gr, state, []File{ci, readme}); err != nil {
+			t.Fatalf("CommitFiles: %v", err)
+		}
+		mr, err := g.OpenMergeRequest(ctx, gr, state)
+		if err != nil {
+			t.Fatalf("OpenMergeRequest: %v", err)
+		}
+		return mr
+	}
+
+	first := run()
+	if first == nil || !first.Created || first.IID != 1 {
+		t.Fatalf("Expected merge request !1 to be created, got %+v", first)
+	}
+	second := run()
+	if second == nil || second.Created || second.IID != 1 {
+		t.Fatalf("Expected the rerun to reuse merge request !1, got %+v", second)
+	}
+
+	// the branch is read once per run
+	want := []string{
+		"read branch gitlab-vault/managed-files",
+		"start gitlab-vault/managed-files from main force=false",
+		"create .gitlab-ci.yml on gitlab-vault/managed-files",
+		"update README.md on gitlab-vault/managed-files",
+		"find user alice",
+		"create merge request gitlab-vault/managed-files -> main labels=gitlab-vault assignees=[7]",
+		"merge !1 when pipeline succeeds=true",
+		// same content, no commit
+		"read branch gitlab-vault/managed-files",
+		"update merge request !1 add_labels=gitlab-vault assignees=[7]",
+		"merge !1 when pipeline succeeds=true",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected calls:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(*calls, "\n"))
+	}
+}
+
+func TestMergeRequestStaleBranch(t *testing.T) {
+	server, calls := setupMockMergeRequests(t)
+	g := &GitlabInfo{
+		Token:    "valid-token",
+		BaseURL:  server.URL + "/api/v4",
+		Delivery: DeliveryMergeRequest,
+	}
+	gr := &GitlabResp{ProjectId: "1", ProjectName: "app", DefaultBranch: "main"}
+	ctx := context.Background()
+	files := []File{{Path: "README.md", Content: "# app\n"}}
+
+	run := func() *MergeRequest {
+		t.Helper()
+		state := branches(t, g, gr)
+		if _, err := g.CommitFiles(ctx, gr, state, files); err != nil {
+			t.Fatalf("CommitFiles: %v", err)
+		}
+		mr, err := g.OpenMergeRequest(ctx, gr, state)
+		if err != nil {
+			t.Fatalf("OpenMergeRequest: %v", err)
+		}
+		return mr
+	}
+	closeMergeRequest := func(iid int) {
+		t.Helper()
+		git, _ := g.Initgitlab(ctx)
+		if _, _, err := git.MergeRequests.UpdateMergeRequest("1", iid, &gitlab.UpdateMergeRequestOptions{StateEvent: gitlab.Ptr("close")}); err != nil {
+			t.Fatalf("could not close !%d: %v", iid, err)
+		}
+	}
+
+	if mr := run(); mr == nil || mr.IID != 1 {
+		t.Fatalf("Expected merge request !1, got %+v", mr)
+	}
+	// the branch of a closed merge request is reset and a new one opened
+	closeMergeRequest(1)
+	if mr := run(); mr == nil || !mr.Created || mr.IID != 2 {
+		t.Fatalf("Expected merge request !2 after !1 was closed, got %+v", mr)
+	}
+	// once the default branch has the files the left over branch goes
+	closeMergeRequest(2)
+	push := &GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"}
+	if _, err := push.CommitFiles(ctx, gr, branches(t, push, gr), files); err != nil {
+		t.Fatalf("CommitFiles: %v", err)
+	}
+	if mr := run(); mr != nil {
+		t.Fatalf("Expected no merge request when main is up to date, got %+v", mr)
+	}
+
+	want := []string{
+		"read branch gitlab-vault/managed-files",
+		"start gitlab-vault/managed-files from main force=false",
+		"update README.md on gitlab-vault/managed-files",
+		"create merge request gitlab-vault/managed-files -> main labels=<nil> assignees=<nil>",
+		"close merge request !1",
+		"read branch gitlab-vault/managed-files",
+		"start gitlab-vault/managed-files from main force=true",
+		"update README.md on gitlab-vault/managed-files",
+		"create merge request gitlab-vault/managed-files -> main labels=<nil> assignees=<nil>",
+		"close merge request !2",
+		"update README.md on main",
+		"read branch gitlab-vault/managed-files",
+		"delete branch gitlab-vault/managed-files",
+	}
+	if strings.Join(*calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected calls:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(*calls, "\n"))
+	}
+}
+
+func TestPlanFilesMergeRequest(t *testing.T) {
+	server, _ := setupMockMergeRequests(t)
+	g := &GitlabInfo{
+		Token:    "valid-token",
+		BaseURL:  server.URL + "/api/v4",
+		Delivery: DeliveryMergeRequest,
+	}
+	gr := &GitlabResp{ProjectId: "1", ProjectName: "app", DefaultBranch: "main"}
+	ctx := context.Background()
+	files := []File{{Path: "README.md", Content: "# app\n"}}
+
+	plans, err := g.PlanFiles(ctx, gr, files)
+	if err != nil || plans[0].Status != FileUpdated || plans[0].Before != "# old\n" {
+		t.Fatalf("Expected the update of main without a merge request, got %+v, %v", plans, err)
+	}
+	state := branches(t, g, gr)
+	if _, err := g.CommitFiles(ctx, gr, state, files); err != nil {
+		t.Fatalf("CommitFiles: %v", err)
+	}
+	if _, err := g.OpenMergeRequest(ctx, gr, state); err != nil {
+		t.Fatalf("OpenMergeRequest: %v", err)
+	}
+	// the open merge request already has the file
+	plans, err = g.PlanFiles(ctx, gr, files)
+	if err != nil || plans[0].Status != FileUnchanged {
+		t.Errorf("Expected the file unchanged on the merge request branch, got %+v, %v", plans, err)
+	}
+}
+
+func TestMergeRequestDeliveryEmptyRepo(t *testing.T) {
+	server, calls := setupMockMergeRequests(t)
+	g := &GitlabInfo{
+		Token:    "valid-token",
+		BaseURL:  server.URL + "/api/v4",
+		Delivery: DeliveryMergeRequest,
+	}
+	gr := &GitlabResp{ProjectId: "1", ProjectName: "app", EmptyRepo: true}
+
+	ctx := context.Background()
+	ci, _ := g.CiFile(gr, "include: []\n")
+	state := branches(t, g, gr)
+	if _, err := g.CommitFiles(ctx, gr, state, []File{ci}); err != nil {
+		t.Fatalf("CommitFiles: %v", err)
+	}
+	mr, err := g.OpenMergeRequest(ctx, gr, state)
+	if err != nil || mr != nil {
+		t.Fatalf("Expected no merge request for an empty repository, got %+v, %v", mr, err)
+	}
+	// nothing to merge into, the first commit goes to the default branch
+	if strings.Join(*calls, ",") != "create .gitlab-ci.yml on main" {
+		t.Errorf("Expected a direct push, got %v", *calls)
+	}
+}
+
 func ListVariables(t *testing.T) {
 
 }
@@ -166,3 +1056,25 @@ func CreateVariable(t *testing.T) {
 func UpdateVariable(t *testing.T) {
 
 }
+
+func TestExpand(t *testing.T) {
+	// two projects with the same name in different groups
+	a := &GitlabResp{ProjectName: "api", ProjectPath: "team-a/api", ProjectId: "1"}
+	b := &GitlabResp{ProjectName: "api", ProjectPath: "team-b/sub/api", ProjectId: "2"}
+	path := "mor/{{project}}/db-{{project_id}}"
+	if got := a.Expand(path); got != "mor/team-a/api/db-1" {
+		t.Errorf("Unexpected path %q", got)
+	}
+	if got := b.Expand(path); got != "mor/team-b/sub/api/db-2" {
+		t.Errorf("Unexpected path %q", got)
+	}
+}
+
+func TestPath(t *testing.T) {
+	if got := (&GitlabResp{ProjectName: "api", ProjectPath: "team-a/api"}).Path(); got != "team-a/api" {
+		t.Errorf("Expected the full path, got %q", got)
+	}
+	if got := (&GitlabResp{ProjectName: "api"}).Path(); got != "api" {
+		t.Errorf("Expected the name without a path, got %q", got)
+	}
+}
@@ -0,0 +1,249 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	gitlab "gitlab.com/gitlab-org/api/client-go"
+)
+
+// Delivery modes of the file changes
+const (
+	// DeliveryPush commits to the default branch
+	DeliveryPush = "push"
+	// DeliveryMergeRequest commits to MergeRequestOptions.Branch and opens a
+	// merge request against the default branch
+	DeliveryMergeRequest = "merge_request"
+)
+
+// DefaultMergeRequestBranch is the branch the changes go to in merge request
+// mode
+const DefaultMergeRequestBranch = "gitlab-vault/managed-files"
+
+type MergeRequestOptions struct {
+	Branch      string   `koanf:"branch"`
+	Title       string   `koanf:"title"`
+	Description string   `koanf:"description"`
+	Labels      []string `koanf:"labels"`
+	// Assignees are usernames
+	Assignees []string `koanf:"assignees"`
+	// AutoMerge merges the request once its pipeline succeeds
+	AutoMerge bool `koanf:"auto_merge"`
+}
+
+// MergeRequest is the merge request of a project after OpenMergeRequest
+type MergeRequest struct {
+	IID     int
+	WebURL  string
+	Created bool
+}
+
+func (o *MergeRequestOptions) branch() string {
+	if o.Branch == "" {
+		return DefaultMergeRequestBranch
+	}
+	return o.Branch
+}
+
+func (o *MergeRequestOptions) title() string {
+	if o.Title == "" {
+		return "Update the files managed by gitlab-vault"
+	}
+	return o.Title
+}
+
+// BranchState tells where the files of a project are read and written, it
+// is passed from CommitFiles to OpenMergeRequest
+type BranchState struct {
+	// read is the branch the current files are read from
+	read string
+	// write is the branch the commit goes to, start the branch it starts
+	// from when write is created or reset
+	write, start string
+	// stale is a merge request branch left without an open merge request,
+	// e.g. closed or whose creation failed, the commit resets it
+	stale bool
+	// exists is set while the merge request branch exists
+	exists bool
+}
+
+// Branches returns where the files of the project go. In merge request mode
+// the branch of the open merge request is reused, otherwise the files are
+// read from the target branch and the merge request branch is created, or
+// reset, from it. Empty repositories and push mode use the project branch.
+func (g *GitlabInfo) Branches(ctx context.Context, gr *GitlabResp) (*BranchState, error) {
+	target := g.Branch(gr)
+	if g.Delivery != DeliveryMergeRequest || gr.EmptyRepo {
+		return &BranchState{read: target, write: target}, nil
+	}
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	source := g.MergeRequest.branch()
+	state := &BranchState{read: target, write: source, start: target}
+	_, resp, err := git.Branches.GetBranch(gr.ProjectId, source, gitlab.WithContext(ctx))
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read branch %s: %v", source, err)
+	}
+
+	open, err := g.openMergeRequests(ctx, git, gr)
+	if err != nil {
+		return nil, err
+	}
+	if len(open) > 0 {
+		return &BranchState{read: source, write: source, exists: true}, nil
+	}
+	state.stale, state.exists = true, true
+	return state, nil
+}
+
+// openMergeRequests lists the open merge requests of the merge request
+// branch into the target branch
+func (g *GitlabInfo) openMergeRequests(ctx context.Context, git *GitlabClient, gr *GitlabResp) ([]*gitlab.BasicMergeRequest, error) {
+	open, _, err := git.MergeRequests.ListProjectMergeRequests(gr.ProjectId, &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.Ptr("opened"),
+		SourceBranch: gitlab.Ptr(g.MergeRequest.branch()),
+		TargetBranch: gitlab.Ptr(g.Branch(gr)),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not list the merge requests: %v", err)
+	}
+	return open, nil
+}
+
+// OpenMergeRequest opens a merge request from the merge request branch, or
+// updates the one already open, and sets its labels and assignees. State is
+// the one CommitFiles was given. It returns nil in push mode, for empty
+// repositories and when the branch is missing or has nothing the target
+// branch does not have.
+func (g *GitlabInfo) OpenMergeRequest(ctx context.Context, gr *GitlabResp, state *BranchState) (*MergeRequest, error) {
+	source, target := g.MergeRequest.branch(), g.Branch(gr)
+	if g.Delivery != DeliveryMergeRequest || state.write != source || !state.exists {
+		return nil, nil
+	}
+	git, err := g.Initgitlab(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	compare, _, err := git.Repositories.Compare(gr.ProjectId, &gitlab.CompareOptions{
+		From: gitlab.Ptr(target),
+		To:   gitlab.Ptr(source),
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("could not compare %s with %s: %v", source, target, err)
+	}
+	if len(compare.Diffs) == 0 {
+		return nil, nil
+	}
+
+	assignees, err := g.assigneeIds(ctx, git)
+	if err != nil {
+		return nil, err
+	}
+	open, err := g.openMergeRequests(ctx, git, gr)
+	if err != nil {
+		return nil, err
+	}
+
+	var mr *gitlab.MergeRequest
+	result := &MergeRequest{}
+	if len(open) > 0 {
+		opt := &gitlab.UpdateMergeRequestOptions{
+			Title: gitlab.Ptr(g.MergeRequest.title()),
+		}
+		if len(g.MergeRequest.Labels) > 0 {
+			// keep the labels the team added
+			opt.AddLabels = gitlab.Ptr(gitlab.LabelOptions(g.MergeRequest.Labels))
+		}
+		if len(assignees) > 0 {
+			opt.AssigneeIDs = &assignees
+		}
+		mr, _, err = git.MergeRequests.UpdateMergeRequest(gr.ProjectId, open[0].IID, opt, gitlab.WithContext(ctx))
+	} else {
+		opt := &gitlab.CreateMergeRequestOptions{
+			Title:              gitlab.Ptr(g.MergeRequest.title()),
+			SourceBranch:       gitlab.Ptr(source),
+			TargetBranch:       gitlab.Ptr(target),
+			RemoveSourceBranch: gitlab.Ptr(true),
+		}
+		if g.MergeRequest.Description != "" {
+			opt.Description = gitlab.Ptr(g.MergeRequest.Description)
+		}
+		if len(g.MergeRequest.Labels) > 0 {
+			opt.Labels = gitlab.Ptr(gitlab.LabelOptions(g.MergeRequest.Labels))
+		}
+		if len(assignees) > 0 {
+			opt.AssigneeIDs = &assignees
+		}
+		mr, _, err = git.MergeRequests.CreateMergeRequest(gr.ProjectId, opt, gitlab.WithContext(ctx))
+		result.Created = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.IID, result.WebURL = mr.IID, mr.WebURL
+
+	if g.MergeRequest.AutoMerge {
+		if err := g.autoMerge(ctx, git, gr, mr.IID); err != nil {
+			return result, fmt.Errorf("could not enable auto-merge on !%d: %v", mr.IID, err)
+		}
+	}
+	return result, nil
+}
+
+// autoMergeAttempts bounds the wait for gitlab to check a new merge request
+const autoMergeAttempts = 3
+
+// autoMergeWait is the pause between the auto-merge attempts
+var autoMergeWait = 2 * time.Second
+
+// autoMerge merges the request once its pipeline succeeds. Gitlab refuses
+// while it is still checking a new merge request, so it is tried again.
+func (g *GitlabInfo) autoMerge(ctx context.Context, git *GitlabClient, gr *GitlabResp, iid int) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var resp *gitlab.Response
+		_, resp, err = git.MergeRequests.AcceptMergeRequest(gr.ProjectId, iid, &gitlab.AcceptMergeRequestOptions{
+			MergeWhenPipelineSucceeds: gitlab.Ptr(true),
+			ShouldRemoveSourceBranch:  gitlab.Ptr(true),
+		}, gitlab.WithContext(ctx))
+		if err == nil || attempt == autoMergeAttempts || resp == nil || resp.StatusCode < 400 || resp.StatusCode >= 500 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(autoMergeWait):
+		}
+	}
+}
+
+// assigneeIds resolves the assignee usernames once for all the workers,
+// the ones calling meanwhile wait for the result
+func (g *GitlabInfo) assigneeIds(ctx context.Context, git *GitlabClient) ([]int, error) {
+	g.assigneesOnce.Do(func() {
+		ids := []int{}
+		for _, username := range g.MergeRequest.Assignees {
+			users, _, err := git.Users.ListUsers(&gitlab.ListUsersOptions{Username: gitlab.Ptr(username)}, gitlab.WithContext(ctx))
+			if err != nil {
+				g.assigneesErr = err
+				return
+			}
+			if len(users) == 0 {
+				g.assigneesErr = fmt.Errorf("unknown assignee %s", username)
+				return
+			}
+			ids = append(ids, users[0].ID)
+		}
+		g.assignees = ids
+	})
+	return g.assignees, g.assigneesErr
+}
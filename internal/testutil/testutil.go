@@ -0,0 +1,101 @@
+// Package testutil holds the vault and gitlab stand-ins shared by the tests
+// of the packages that sync secrets into projects
+package testutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gitlab-vault/vault"
+)
+
+// SecretStore is an in-memory kv store keyed by <mount>/<path>, Writes
+// counts the WriteSecret calls
+type SecretStore struct {
+	Secrets map[string]map[string]interface{}
+	Writes  int
+
+	mu sync.Mutex
+}
+
+// NewSecretStore returns a store holding secrets, which may be nil
+func NewSecretStore(secrets map[string]map[string]interface{}) *SecretStore {
+	if secrets == nil {
+		secrets = map[string]map[string]interface{}{}
+	}
+	return &SecretStore{Secrets: secrets}
+}
+
+func (s *SecretStore) ReadSecret(ctx context.Context, mount, path string) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.Secrets[mount+"/"+path]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s/%s", vault.ErrSecretNotFound, mount, path)
+	}
+	return data, nil
+}
+
+func (s *SecretStore) WriteSecret(ctx context.Context, mount, path string, data map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Writes++
+	s.Secrets[mount+"/"+path] = data
+	return nil
+}
+
+// MockVariables serves the CI variables of project 1 and records the writes
+// as "create KEY", "update KEY masked=M [description]" and "delete KEY"
+func MockVariables(t *testing.T, vars []map[string]interface{}) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	writes := []string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/variables", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(vars)
+		case http.MethodPost:
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			writes = append(writes, fmt.Sprintf("create %s", body["key"]))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(body)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/api/v4/projects/1/variables/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/variables/")
+		switch r.Method {
+		case http.MethodPut:
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			write := fmt.Sprintf("update %s masked=%v", key, body["masked"])
+			if d, _ := body["description"].(string); d != "" {
+				write += " " + d
+			}
+			writes = append(writes, write)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(body)
+		case http.MethodDelete:
+			writes = append(writes, "delete "+key)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &writes
+}
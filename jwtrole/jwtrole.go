@@ -0,0 +1,239 @@
+package jwtrole
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab-vault/gitlab"
+)
+
+// DefaultPrefix starts the role and policy names, the zone and the project
+// id follow it
+const DefaultPrefix = "gitlab-project-"
+
+// Statuses of a role after Sync
+const (
+	Created = "created"
+	Updated = "updated"
+	Stale   = "stale"
+	Pruned  = "pruned"
+)
+
+// Rule grants capabilities on a vault path in the project policy
+type Rule struct {
+	// Path is a policy path, {{project}} and {{project_id}} are replaced with
+	// the full path and the id of each project, e.g.
+	// secret/data/mor/{{project}}/*
+	Path string `koanf:"path"`
+	// Capabilities default to read
+	Capabilities []string `koanf:"capabilities"`
+}
+
+type Config struct {
+	// Mount is the jwt auth mount the CI jobs log in with
+	Mount  string `koanf:"mount"`
+	Prefix string `koanf:"prefix"`
+	// BoundAudiences must match the aud of the CI id_tokens
+	BoundAudiences []string `koanf:"bound_audiences"`
+	// UserClaim names the token entity, defaults to project_path
+	UserClaim string `koanf:"user_claim"`
+	// RefProtected only lets jobs of protected branches and tags log in
+	RefProtected bool   `koanf:"ref_protected"`
+	TokenTtl     string `koanf:"token_ttl"`
+	Policy       []Rule `koanf:"policy"`
+	// Prune deletes the roles and policies of projects that are gone,
+	// otherwise they are only reported
+	Prune bool `koanf:"prune"`
+}
+
+// Vault writes policies and jwt roles, vault.Lifecycle implements it
+type Vault interface {
+	WritePolicy(ctx context.Context, name, policy string) error
+	DeletePolicy(ctx context.Context, name string) error
+	WriteJwtRole(ctx context.Context, mount, name string, role map[string]interface{}) error
+	ListJwtRoles(ctx context.Context, mount string) ([]string, error)
+	DeleteJwtRole(ctx context.Context, mount, name string) error
+}
+
+// Result is one role after Sync
+type Result struct {
+	Role    string
+	Project string
+	Status  string
+}
+
+type Bootstrapper struct {
+	Vault  Vault
+	Config Config
+	// Zone is part of the names, the roles of the other zones sharing the
+	// mount are never reported or pruned
+	Zone string
+}
+
+// Validate checks the configuration before any role is written
+func (b *Bootstrapper) Validate() error {
+	if b.Config.Mount == "" {
+		b.Config.Mount = "jwt"
+	}
+	if b.Config.Prefix == "" {
+		b.Config.Prefix = DefaultPrefix
+	}
+	if b.Zone == "" || strings.ContainsAny(b.Zone, "/ ") {
+		return fmt.Errorf("invalid jwt roles zone %q", b.Zone)
+	}
+	if b.Config.UserClaim == "" {
+		b.Config.UserClaim = "project_path"
+	}
+	// vault rejects tokens with an aud claim on roles without audiences,
+	// and gitlab id_tokens always have one
+	if len(b.Config.BoundAudiences) == 0 {
+		return errors.New("jwt_roles.bound_audiences is empty, set it to the aud of the CI id_tokens")
+	}
+	if len(b.Config.Policy) == 0 {
+		return errors.New("jwt_roles.policy grants nothing")
+	}
+	for _, r := range b.Config.Policy {
+		if strings.TrimSpace(r.Path) == "" {
+			return errors.New("jwt_roles.policy has a rule without path")
+		}
+		if strings.ContainsAny(r.Path, "\"\n") {
+			return fmt.Errorf("invalid policy path %q", r.Path)
+		}
+	}
+	return nil
+}
+
+// Name is the role and policy name of a project
+func (b *Bootstrapper) Name(gr *gitlab.GitlabResp) string {
+	return b.scope() + gr.ProjectId
+}
+
+// scope starts the names of the roles of the zone
+func (b *Bootstrapper) scope() string {
+	return b.Config.Prefix + b.Zone + "-"
+}
+
+// owns tells if name is the name of a role of the zone, the project id ends
+// it so that zone prod does not own the roles of zone prod-eu
+func (b *Bootstrapper) owns(name string) bool {
+	id, ok := strings.CutPrefix(name, b.scope())
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(id)
+	return err == nil
+}
+
+// Policy renders the HCL policy of a project
+func (b *Bootstrapper) Policy(gr *gitlab.GitlabResp) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# generated by gitlab-vault for project %s (%s), do not edit\n", gr.ProjectName, gr.ProjectId)
+	for _, r := range b.Config.Policy {
+		capabilities := r.Capabilities
+		if len(capabilities) == 0 {
+			capabilities = []string{"read"}
+		}
+		quoted := make([]string, len(capabilities))
+		for i, c := range capabilities {
+			quoted[i] = fmt.Sprintf("%q", c)
+		}
+		fmt.Fprintf(&sb, "path %q {\n  capabilities = [ %s ]\n}\n", gr.Expand(r.Path), strings.Join(quoted, ", "))
+	}
+	return sb.String()
+}
+
+// Role returns the jwt role of a project, bound to its project_id
+func (b *Bootstrapper) Role(gr *gitlab.GitlabResp) map[string]interface{} {
+	claims := map[string]interface{}{
+		"project_id": gr.ProjectId,
+	}
+	if b.Config.RefProtected {
+		claims["ref_protected"] = "true"
+	}
+	role := map[string]interface{}{
+		"role_type":         "jwt",
+		"user_claim":        b.Config.UserClaim,
+		"bound_audiences":   b.Config.BoundAudiences,
+		"bound_claims_type": "string",
+		"bound_claims":      claims,
+		"token_policies":    []string{b.Name(gr)},
+	}
+	if b.Config.TokenTtl != "" {
+		role["token_ttl"] = b.Config.TokenTtl
+	}
+	return role
+}
+
+// Sync writes the policy and the role of every project, then reports, or
+// prunes, the roles of the zone that match none of all. all must be every
+// project of the zone namespace, archived or not selected ones included, so
+// that only the roles of deleted projects go.
+func (b *Bootstrapper) Sync(ctx context.Context, projects, all []*gitlab.GitlabResp) ([]Result, error) {
+	existing, err := b.Vault.ListJwtRoles(ctx, b.Config.Mount)
+	if err != nil {
+		return nil, fmt.Errorf("could not list the roles of %s: %v", b.Config.Mount, err)
+	}
+	known := map[string]bool{}
+	for _, r := range existing {
+		known[r] = true
+	}
+
+	wanted := map[string]bool{}
+	for _, gr := range all {
+		wanted[b.Name(gr)] = true
+	}
+
+	results := []Result{}
+	var errs []error
+	for _, gr := range projects {
+		name := b.Name(gr)
+		if err := b.Vault.WritePolicy(ctx, name, b.Policy(gr)); err != nil {
+			errs = append(errs, fmt.Errorf("could not write policy %s: %v", name, err))
+			continue
+		}
+		if err := b.Vault.WriteJwtRole(ctx, b.Config.Mount, name, b.Role(gr)); err != nil {
+			errs = append(errs, fmt.Errorf("could not write role %s: %v", name, err))
+			continue
+		}
+		status := Created
+		if known[name] {
+			status = Updated
+		}
+		results = append(results, Result{Role: name, Project: gr.ProjectName, Status: status})
+	}
+
+	sort.Strings(existing)
+	for _, name := range existing {
+		if !b.owns(name) || wanted[name] {
+			continue
+		}
+		result := Result{Role: name, Status: Stale}
+		if b.Config.Prune {
+			if err := b.Vault.DeleteJwtRole(ctx, b.Config.Mount, name); err != nil {
+				errs = append(errs, fmt.Errorf("could not delete role %s: %v", name, err))
+			} else if err := b.Vault.DeletePolicy(ctx, name); err != nil {
+				errs = append(errs, fmt.Errorf("could not delete policy %s: %v", name, err))
+			} else {
+				result.Status = Pruned
+			}
+		}
+		results = append(results, result)
+	}
+	return results, errors.Join(errs...)
+}
+
+// Report writes the roles as a table
+func Report(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tPROJECT\tSTATUS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Role, r.Project, r.Status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,173 @@
+package jwtrole
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+)
+
+type fakeVault struct {
+	policies map[string]string
+	roles    map[string]map[string]interface{}
+}
+
+func (f *fakeVault) WritePolicy(ctx context.Context, name, policy string) error {
+	f.policies[name] = policy
+	return nil
+}
+
+func (f *fakeVault) DeletePolicy(ctx context.Context, name string) error {
+	delete(f.policies, name)
+	return nil
+}
+
+func (f *fakeVault) WriteJwtRole(ctx context.Context, mount, name string, role map[string]interface{}) error {
+	f.roles[mount+"/"+name] = role
+	return nil
+}
+
+func (f *fakeVault) ListJwtRoles(ctx context.Context, mount string) ([]string, error) {
+	names := []string{}
+	for k := range f.roles {
+		if name, ok := strings.CutPrefix(k, mount+"/"); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (f *fakeVault) DeleteJwtRole(ctx context.Context, mount, name string) error {
+	delete(f.roles, mount+"/"+name)
+	return nil
+}
+
+func TestPolicy(t *testing.T) {
+	b := &Bootstrapper{Zone: "prod", Config: Config{
+		BoundAudiences: []string{"https://vault.example.com"},
+		Policy: []Rule{
+			{Path: "secret/data/mor/{{project}}/*"},
+			{Path: "secret/metadata/mor/{{project}}/*", Capabilities: []string{"read", "list"}},
+		},
+	}}
+	if err := b.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	got := b.Policy(&gitlab.GitlabResp{ProjectName: "myproject", ProjectPath: "grp/myproject", ProjectId: "42"})
+	want := `# generated by gitlab-vault for project myproject (42), do not edit
+path "secret/data/mor/grp/myproject/*" {
+  capabilities = [ "read" ]
+}
+path "secret/metadata/mor/grp/myproject/*" {
+  capabilities = [ "read", "list" ]
+}
+`
+	if got != want {
+		t.Errorf("Expected policy:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		config Config
+	}{
+		{name: "no audience", zone: "prod", config: Config{Policy: []Rule{{Path: "secret/data/x"}}}},
+		{name: "no policy", zone: "prod", config: Config{BoundAudiences: []string{"aud"}}},
+		{name: "quoted path", zone: "prod", config: Config{BoundAudiences: []string{"aud"}, Policy: []Rule{{Path: `x" {`}}}},
+		{name: "no zone", config: Config{BoundAudiences: []string{"aud"}, Policy: []Rule{{Path: "secret/data/x"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bootstrapper{Config: tt.config, Zone: tt.zone}
+			if err := b.Validate(); err == nil {
+				t.Error("Expected error but got none")
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	for _, prune := range []bool{false, true} {
+		v := &fakeVault{
+			policies: map[string]string{"gitlab-project-prod-1": "old", "gitlab-project-prod-9": "gone", "team": "kept"},
+			roles: map[string]map[string]interface{}{
+				"jwt/gitlab-project-prod-1": {},
+				"jwt/gitlab-project-prod-9": {},
+				"jwt/team":                  {},
+				// roles of the other zones sharing the mount
+				"jwt/gitlab-project-dev-9":     {},
+				"jwt/gitlab-project-prod-eu-9": {},
+			},
+		}
+		b := &Bootstrapper{Vault: v, Zone: "prod", Config: Config{
+			BoundAudiences: []string{"https://vault.example.com"},
+			RefProtected:   true,
+			Policy:         []Rule{{Path: "secret/data/mor/{{project}}/*"}},
+			Prune:          prune,
+		}}
+		if err := b.Validate(); err != nil {
+			t.Fatalf("Validate: %v", err)
+		}
+
+		projects := []*gitlab.GitlabResp{
+			{ProjectName: "one", ProjectId: "1"},
+			{ProjectName: "two", ProjectId: "2"},
+		}
+		// project 3 exists but is not selected, project 4 is archived, their
+		// roles are not stale
+		v.roles["jwt/gitlab-project-prod-3"] = map[string]interface{}{}
+		v.roles["jwt/gitlab-project-prod-4"] = map[string]interface{}{}
+		all := append(projects,
+			&gitlab.GitlabResp{ProjectName: "three", ProjectId: "3"},
+			&gitlab.GitlabResp{ProjectName: "four", ProjectId: "4"},
+		)
+		results, err := b.Sync(context.Background(), projects, all)
+		if err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+
+		stale := Stale
+		if prune {
+			stale = Pruned
+		}
+		want := []Result{
+			{Role: "gitlab-project-prod-1", Project: "one", Status: Updated},
+			{Role: "gitlab-project-prod-2", Project: "two", Status: Created},
+			{Role: "gitlab-project-prod-9", Status: stale},
+		}
+		if !reflect.DeepEqual(results, want) {
+			t.Errorf("prune=%v: expected results %v, got %v", prune, want, results)
+		}
+
+		role := v.roles["jwt/gitlab-project-prod-2"]
+		claims := role["bound_claims"].(map[string]interface{})
+		if claims["project_id"] != "2" || claims["ref_protected"] != "true" {
+			t.Errorf("Expected the role bound to project 2 and protected refs, got %v", claims)
+		}
+		if !reflect.DeepEqual(role["token_policies"], []string{"gitlab-project-prod-2"}) {
+			t.Errorf("Expected the project policy, got %v", role["token_policies"])
+		}
+		for _, kept := range []string{"gitlab-project-prod-3", "gitlab-project-prod-4", "team", "gitlab-project-dev-9", "gitlab-project-prod-eu-9"} {
+			if _, ok := v.roles["jwt/"+kept]; !ok {
+				t.Errorf("prune=%v: expected role %s to be kept", prune, kept)
+			}
+		}
+		_, gone := v.roles["jwt/gitlab-project-prod-9"]
+		_, gonePolicy := v.policies["gitlab-project-prod-9"]
+		if prune == gone || prune == gonePolicy {
+			t.Errorf("prune=%v: unexpected stale role present=%v policy present=%v", prune, gone, gonePolicy)
+		}
+
+		var buf bytes.Buffer
+		Report(&buf, results)
+		if !strings.Contains(buf.String(), "gitlab-project-prod-9") {
+			t.Errorf("Expected the stale role in the report, got:\n%s", buf.String())
+		}
+	}
+}
@@ -3,12 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
+	"gitlab-vault/cilint"
+	"gitlab-vault/deploykey"
+	"gitlab-vault/fileset"
 	"gitlab-vault/gitlab"
+	"gitlab-vault/jwtrole"
+	"gitlab-vault/migrate"
+	"gitlab-vault/plan"
+	"gitlab-vault/render"
+	"gitlab-vault/selection"
+	"gitlab-vault/varsync"
 	"gitlab-vault/vault"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -21,11 +31,72 @@ import (
 )
 
 type GitopsInfo struct {
+	// Command is the first argument, empty for the default run
+	Command     string
+	DryRun      bool
 	ClusterName string
 	ProductLine string
+	Zone        string
 	GitlabNs    string
-	VaultAddr   string
-	AuthType    string
+	// IncludeSubgroups also lists the projects of the subgroups of GitlabNs
+	IncludeSubgroups bool
+	// Branch and CiConfigPath override the default branch and the CI file
+	// path of every project, empty follows each project settings
+	Branch       string
+	CiConfigPath string
+	// Delivery pushes the files to the branch, or opens a merge request
+	// with them in merge_request mode
+	Delivery     string
+	MergeRequest gitlab.MergeRequestOptions
+	// TemplatesDir holds the managed files, at their repository paths
+	TemplatesDir string
+	// CiLint checks the rendered CI file of every project before any write
+	CiLint cilint.Config
+	// PlanFormat is the output of the plan command, text or json
+	PlanFormat string
+	// Commit sets the message and author of the managed files commit
+	Commit gitlab.CommitOptions
+	// GitlabRateLimit caps the gitlab calls per second, zero follows gitlab
+	GitlabRateLimit float64
+	VaultAddr       string
+	// KvMount, KvVersion and SecretVersion locate the gitlab credentials,
+	// KvVersion 0 detects the engine version and SecretVersion 0 reads
+	// the latest version
+	KvMount       string
+	KvVersion     int
+	SecretVersion int
+	// AuthNamespace and SecretNamespace are the vault namespaces of the
+	// login and of the kv reads
+	AuthNamespace   string
+	SecretNamespace string
+	// GitlabTokenRole, when set, requests a short lived gitlab token from
+	// the vault gitlab secrets engine mounted on GitlabTokenMount instead
+	// of reading it from kv
+	GitlabTokenMount string
+	GitlabTokenRole  string
+	// AgeFile is the age encrypted gitlab credentials of auth_type age,
+	// decrypted with the identities of AgeKeyEnv or AgeKeyFile
+	AgeFile    string
+	AgeKeyEnv  string
+	AgeKeyFile string
+	AuthType   string
+	K8sMount   string
+	K8sRole    string
+	K8sJwtPath string
+	JwtMount   string
+	JwtRole    string
+	JwtEnv     string
+	JwtPath    string
+	// Variables maps vault kv fields to the CI variables of every project
+	Variables []varsync.Mapping
+	Migrate   migrate.Config
+	// Projects selects the projects of the zone
+	Projects selection.Config
+	// DeployKeys gives every project a deploy key, disabled without a path
+	DeployKeys deploykey.Config
+	// JwtRoles creates a vault jwt role and policy per project, disabled
+	// without a policy
+	JwtRoles jwtrole.Config
 }
 
 type ProfilingInfo struct {
@@ -42,23 +113,47 @@ func main() {
 	if prof.CpuProfile != "" || prof.MemProfile != "" {
 		go Profiling(prof)
 	}
-	fmt.Printf("Gitops Info: %+v\n", gi)
+	// stdout is left to the reports, the plan can be json
+	log.Printf("Gitops Info: %+v", gi)
 
-	if err := validateEnvVars(); err != nil {
-		log.Fatalf("Configuration error: %v", err)
+	// run returns once its deferred revokes are done
+	if err := run(gi); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run does the command of gi. Every setting is checked before the vault
+// login, and the errors are returned so that the vault token and the gitlab
+// token lease are revoked on the way out.
+func run(gi *GitopsInfo) error {
+	switch gi.Command {
+	case "", "migrate", "plan":
+	default:
+		return fmt.Errorf("unknown command %q", gi.Command)
+	}
+
+	if err := validateEnvVars(gi); err != nil {
+		return fmt.Errorf("configuration error: %v", err)
 	}
 
 	vault_addr := gi.VaultAddr
 	role_id := os.Getenv("role_id")
 	secret_id := os.Getenv("secret_id")
+	wrapping_token := os.Getenv("secret_id_wrapping_token")
 	token := os.Getenv("vault_token")
 	gitlab_url := os.Getenv("gitlab_url")
 
-	var reqApprole vault.GetCreds
+	var reqApprole vault.Authenticator
 
 	switch gi.AuthType {
 	case "approle":
-		if gi.ProductLine == "prd" {
+		if wrapping_token != "" {
+			if gi.ProductLine == "prd" {
+				reqApprole = vault.NewCredsApproleWrapped(vault_addr, "mor/prod/gitlab", role_id, wrapping_token)
+			} else {
+				reqApprole = vault.NewCredsApproleWrapped(vault_addr, "mor/stg/gitlab", role_id, wrapping_token)
+			}
+		} else if gi.ProductLine == "prd" {
 			reqApprole = vault.NewCredsApprole(vault_addr, "mor/prod/gitlab", role_id, secret_id)
 		} else {
 			reqApprole = vault.NewCredsApprole(vault_addr, "mor/stg/gitlab", role_id, secret_id)
@@ -69,44 +164,133 @@ func main() {
 		} else {
 			reqApprole = vault.NewCreds(vault_addr, "mor/stg/gitlab", token)
 		}
+	case "kubernetes":
+		if gi.ProductLine == "prd" {
+			reqApprole = vault.NewCredsKubernetes(vault_addr, "mor/prod/gitlab", gi.K8sMount, gi.K8sRole, gi.K8sJwtPath)
+		} else {
+			reqApprole = vault.NewCredsKubernetes(vault_addr, "mor/stg/gitlab", gi.K8sMount, gi.K8sRole, gi.K8sJwtPath)
+		}
+	case "jwt":
+		if gi.ProductLine == "prd" {
+			reqApprole = vault.NewCredsJwt(vault_addr, "mor/prod/gitlab", gi.JwtMount, gi.JwtRole, gi.JwtEnv, gi.JwtPath)
+		} else {
+			reqApprole = vault.NewCredsJwt(vault_addr, "mor/stg/gitlab", gi.JwtMount, gi.JwtRole, gi.JwtEnv, gi.JwtPath)
+		}
 	}
 
 	gitlab_info := &gitlab.GitlabInfo{
-		BaseURL:  gitlab_url,
-		GitlabNs: gi.GitlabNs,
+		BaseURL:              gitlab_url,
+		GitlabNs:             gi.GitlabNs,
+		IncludeSubgroups:     gi.IncludeSubgroups,
+		RequestsPerSecond:    gi.GitlabRateLimit,
+		BranchOverride:       gi.Branch,
+		CiConfigPathOverride: gi.CiConfigPath,
+		Delivery:             gi.Delivery,
+		MergeRequest:         gi.MergeRequest,
+		Commit:               gi.Commit,
+	}
+
+	// the vault token is only requested once the run is set up
+	var vaultLifecycle *vault.Lifecycle
+	if gi.AuthType != "age" {
+		secret := reqApprole.Secret()
+		secret.Mount = gi.KvMount
+		secret.KvVersion = gi.KvVersion
+		secret.Version = gi.SecretVersion
+
+		namespaces := reqApprole.Namespaces()
+		namespaces.Auth = gi.AuthNamespace
+		namespaces.Secret = gi.SecretNamespace
+
+		vaultLifecycle = vault.NewLifecycle(reqApprole)
+	}
+
+	r, err := newRunner(gi, gitlab_info, vaultLifecycle)
+	if err != nil {
+		return err
 	}
 
 	log.Println("Getting Vault token...")
-	// interript signal chan
-	mychan := make(chan os.Signal, 1)
-	signal.Notify(mychan, syscall.SIGINT, syscall.SIGTERM)
+	// a signal cancels every phase, the revokes below still run
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var creds vault.GetCreds
+	if vaultLifecycle == nil {
+		// no vault, the gitlab credentials come from a local encrypted file
+		creds = vault.NewCredsAgeFile(gi.AgeFile, gi.AgeKeyEnv, gi.AgeKeyFile)
+	} else {
+		// keep the vault token alive for the whole run and revoke it at the end
+		if err := vaultLifecycle.Start(ctx); err != nil {
+			return fmt.Errorf("could not log in to vault: %v", err)
+		}
+		defer vaultLifecycle.Stop(context.Background())
+
+		creds = vaultLifecycle
+		if gi.GitlabTokenRole != "" {
+			gitlabToken := vault.NewGitlabToken(vaultLifecycle, gi.GitlabTokenMount, gi.GitlabTokenRole)
+			// runs before the vault token is revoked
+			defer gitlabToken.Revoke(context.Background())
+			creds = gitlabToken
+		}
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	resp, err := vault.GetSecret(reqApprole, ctx)
+	resp, err := vault.GetSecret(creds, ctx)
 	if err != nil {
-		log.Fatalf("Could not get credentials: %v", err)
+		return fmt.Errorf("could not get credentials: %v", err)
 	}
 
 	log.Printf("Vault response: %+v", resp)
 	if resp.Token == nil {
-		log.Fatal("No token received from Vault")
+		return fmt.Errorf("no token received from Vault")
 	}
 
 	token, ok := resp.Token["token"].(string)
 	if !ok || token == "" {
-		log.Fatal("Invalid or empty token received from Vault")
+		return fmt.Errorf("invalid or empty token received from Vault")
 	}
 	gitlab_info.Token = token
 	log.Println("Successfully got Vault token")
 
 	// List GitLab projects
 	log.Println("Listing GitLab projects...")
-	projects, err := gitlab_info.ListProject(ctx)
+	allProjects, err := gitlab_info.ListProject(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list projects: %v", err)
+	}
+	projects, skipped := r.selector.Select(ctx, allProjects)
+	log.Printf("Found %d projects, %d selected", len(allProjects), len(projects))
+
+	if gi.Command == "migrate" {
+		runMigrate(ctx, gi, r.migrator, projects)
+		reportSkipped(skipped)
+		return interrupted(ctx)
+	}
+
+	projects, skipped, err = runCiLint(ctx, gitlab_info, r.checker, r.templates, projects, skipped)
 	if err != nil {
-		log.Fatalf("Could not list projects: %v", err)
+		return err
+	}
+
+	if gi.Command == "plan" {
+		return runPlan(ctx, gi, gitlab_info, r.templates, r.syncer, projects, skipped)
+	}
+
+	// the errors of the jwt roles and of the projects, reported at the end
+	// of the run
+	var errors []error
+
+	if r.bootstrapper != nil {
+		if err := runJwtRoles(ctx, gitlab_info, r.bootstrapper, projects); err != nil {
+			// the files and variables are written all the same
+			errors = append(errors, err)
+		}
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
 	}
-	log.Printf("Found %d projects", len(projects))
+
+	templates, syncer, deployKeys := r.templates, r.syncer, r.deployKeys
 
 	// Create channel for projects and errors
 	projectChan := make(chan *gitlab.GitlabResp, len(projects))
@@ -120,19 +304,45 @@ func main() {
 		go func(workerID int) {
 			defer wg.Done()
 			for project := range projectChan {
-				log.Printf("Worker %d processing project: %s", workerID, project.ProjectName)
+				if ctx.Err() != nil {
+					// interrupted, the rest of the projects are left as is
+					continue
+				}
+				log.Printf("Worker %d processing project: %s (%s)", workerID, project.ProjectName, project.ProjectPath)
 
-				log.Printf("Adding Gitlab CI file for project %s", project.ProjectName)
-				if err := gitlab_info.AddGitlabCiFile(ctx, project, k.String("gitlab-ci-content")); err != nil {
-					errorChan <- fmt.Errorf("could not add Gitlab CI file for project %s: %v", project.ProjectName, err)
+				files, err := templates.Files(ctx, project)
+				if err != nil {
+					errorChan <- fmt.Errorf("could not render the files of project %s: %v", project.ProjectName, err)
 					continue
 				}
 
-				log.Printf("Adding Gitlab README file for project %s", project.ProjectName)
-				if err := gitlab_info.AddGitlabReadmeFile(ctx, project, k.String("gitlab-readme-content")); err != nil {
-					errorChan <- fmt.Errorf("could not add Gitlab README file for project %s: %v", project.ProjectName, err)
+				branches, err := gitlab_info.Branches(ctx, project)
+				if err != nil {
+					errorChan <- fmt.Errorf("could not read the branches of project %s: %v", project.ProjectName, err)
+					continue
+				}
+				log.Printf("Committing %d managed files for project %s", len(files), project.ProjectName)
+				results, err := gitlab_info.CommitFiles(ctx, project, branches, files)
+				if err != nil {
+					errorChan <- fmt.Errorf("could not commit the files of project %s: %v", project.ProjectName, err)
 					continue
 				}
+				for _, r := range results {
+					log.Printf("File %s for project %s: %s", r.Path, project.ProjectName, r.Status)
+				}
+
+				// nothing to review when the branch has nothing new
+				mr, err := gitlab_info.OpenMergeRequest(ctx, project, branches)
+				if mr != nil {
+					action := "Updated"
+					if mr.Created {
+						action = "Opened"
+					}
+					log.Printf("%s merge request !%d for project %s: %s", action, mr.IID, project.ProjectName, mr.WebURL)
+				}
+				if err != nil {
+					errorChan <- fmt.Errorf("could not open the merge request of project %s: %v", project.ProjectName, err)
+				}
 
 				log.Printf("Processing variables for project %s", project.ProjectName)
 				vars, err := gitlab_info.ListVariables(ctx, project)
@@ -142,10 +352,39 @@ func main() {
 				}
 
 				for _, v := range vars {
+					// variables mapped from vault are left to the sync
+					if syncer.Manages(v.Key, v.EnvironmentScope) {
+						continue
+					}
 					if err := gitlab_info.UpdateVariable(ctx, project, v); err != nil {
 						errorChan <- fmt.Errorf("could not update variable %s for project %s: %v", v.Key, project.ProjectName, err)
 					}
 				}
+
+				if len(syncer.Mappings) > 0 {
+					log.Printf("Syncing vault variables for project %s", project.ProjectName)
+					changes, err := syncer.Sync(ctx, project)
+					for _, c := range changes {
+						log.Printf("Variable %s (%s) for project %s: %s", c.Key, c.EnvironmentScope, project.ProjectName, c.Status)
+					}
+					if err != nil {
+						errorChan <- fmt.Errorf("could not sync variables for project %s: %v", project.ProjectName, err)
+					}
+				}
+
+				if deployKeys != nil {
+					log.Printf("Checking the deploy key of project %s", project.ProjectName)
+					result, err := deployKeys.Ensure(ctx, project)
+					if result != nil {
+						log.Printf("Deploy key %d for project %s: %s", result.KeyId, project.ProjectName, result.Status)
+						for _, id := range result.Removed {
+							log.Printf("Removed deploy key %d from project %s", id, project.ProjectName)
+						}
+					}
+					if err != nil {
+						errorChan <- fmt.Errorf("could not set the deploy key for project %s: %v", project.ProjectName, err)
+					}
+				}
 			}
 		}(i)
 	}
@@ -165,7 +404,6 @@ func main() {
 	}()
 
 	// Gestion des erreurs et arrêt
-	var errors []error
 	for {
 		select {
 		case err, ok := <-errorChan:
@@ -175,34 +413,335 @@ func main() {
 			}
 			errors = append(errors, err)
 		case <-doneChan:
+			reportSkipped(skipped)
 			if len(errors) > 0 {
 				log.Printf("Completed with %d errors:", len(errors))
 				for _, err := range errors {
 					log.Println(err)
 				}
-			} else {
+			} else if ctx.Err() == nil {
 				log.Println("Successfully processed all projects")
 			}
-			return
-		case sig := <-mychan:
-			log.Printf("Received signal: %s. Exiting...", sig)
-			cancel()
-			return
+			return interrupted(ctx)
+		}
+	}
+}
+
+// runner holds the validated parts of a run, they are all set up before
+// the vault login
+type runner struct {
+	syncer       *varsync.Syncer
+	templates    *fileset.Set
+	selector     *selection.Selector
+	checker      *cilint.Checker
+	deployKeys   *deploykey.Manager
+	migrator     *migrate.Migrator
+	bootstrapper *jwtrole.Bootstrapper
+}
+
+// newRunner builds and validates the parts of the run, secrets is nil with
+// auth type age
+func newRunner(gi *GitopsInfo, gitlab_info *gitlab.GitlabInfo, secrets *vault.Lifecycle) (*runner, error) {
+	r := &runner{
+		syncer: &varsync.Syncer{
+			Gitlab:   gitlab_info,
+			Secrets:  secrets,
+			Mappings: gi.Variables,
+		},
+		selector: &selection.Selector{
+			Labels: gitlab_info,
+			Config: gi.Projects,
+		},
+		checker: &cilint.Checker{
+			Gitlab: gitlab_info,
+			Config: gi.CiLint,
+		},
+	}
+	if err := r.syncer.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid variables configuration: %v", err)
+	}
+	if err := r.selector.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid projects configuration: %v", err)
+	}
+	if err := r.checker.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid ci_lint configuration: %v", err)
+	}
+
+	var err error
+	if r.templates, err = loadTemplates(gi, gitlab_info); err != nil {
+		return nil, fmt.Errorf("invalid templates: %v", err)
+	}
+
+	if gi.DeployKeys.Path != "" {
+		r.deployKeys = &deploykey.Manager{
+			Gitlab:  gitlab_info,
+			Secrets: secrets,
+			Config:  gi.DeployKeys,
+		}
+		// a nil *vault.Lifecycle in the interface would not be a nil Signer
+		if gi.DeployKeys.SshRole != "" && secrets != nil {
+			r.deployKeys.Signer = secrets
+		}
+		if err := r.deployKeys.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid deploy_keys configuration: %v", err)
+		}
+	}
+
+	if gi.Command == "migrate" {
+		r.migrator = &migrate.Migrator{
+			Gitlab:  gitlab_info,
+			Secrets: secrets,
+			Config:  gi.Migrate,
+			DryRun:  gi.DryRun,
+		}
+		if err := r.migrator.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid migrate configuration: %v", err)
+		}
+	}
+
+	if len(gi.JwtRoles.Policy) > 0 {
+		r.bootstrapper = &jwtrole.Bootstrapper{
+			Vault:  secrets,
+			Config: gi.JwtRoles,
+			Zone:   gi.Zone,
+		}
+		if err := r.bootstrapper.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid jwt_roles configuration: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// loadTemplates parses the managed files of the templates directory once
+// for all projects
+func loadTemplates(gi *GitopsInfo, gitlab_info *gitlab.GitlabInfo) (*fileset.Set, error) {
+	engine := &render.Engine{
+		Zone:        gi.Zone,
+		ClusterName: gi.ClusterName,
+		ProductLine: gi.ProductLine,
+	}
+	set, err := fileset.Load(os.DirFS(gi.TemplatesDir), engine, gitlab_info)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", gi.TemplatesDir, err)
+	}
+	set.CiPath = gitlab_info.CiConfigPath
+	return set, nil
+}
+
+// runCiLint lints the CI file of every project before anything is written.
+// The projects that fail are skipped, and the run is aborted when there are
+// too many of them.
+func runCiLint(ctx context.Context, gitlab_info *gitlab.GitlabInfo, checker *cilint.Checker, templates *fileset.Set, projects []*gitlab.GitlabResp, skipped []selection.Skipped) ([]*gitlab.GitlabResp, []selection.Skipped, error) {
+	if checker.Config.Disabled {
+		return projects, skipped, nil
+	}
+
+	log.Printf("Linting the CI file of %d projects", len(projects))
+	valid, failures, err := checker.Check(ctx, projects, func(gr *gitlab.GitlabResp) (string, error) {
+		f, ok, err := templates.Ci(ctx, gr)
+		if err != nil || !ok {
+			return "", err
+		}
+		// lint what would be written, merged with the current file
+		plans, err := gitlab_info.PlanFiles(ctx, gr, []gitlab.File{f})
+		if err != nil || plans[0].Status == gitlab.FileUnchanged {
+			return "", err
+		}
+		return plans[0].After, nil
+	})
+	if err := interrupted(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err != nil {
+		cilint.Report(os.Stderr, failures)
+		return nil, nil, fmt.Errorf("aborting, nothing was written: %v", err)
+	}
+	for _, f := range failures {
+		skipped = append(skipped, selection.Skipped{Project: f.Project, Reason: "CI lint: " + strings.Join(f.Errors, "; ")})
+	}
+	return valid, skipped, nil
+}
+
+// runPlan prints what a run would change in the files and the variables of
+// every project, without changing anything. It fails when a project could
+// not be planned.
+func runPlan(ctx context.Context, gi *GitopsInfo, gitlab_info *gitlab.GitlabInfo, templates *fileset.Set, syncer *varsync.Syncer, projects []*gitlab.GitlabResp, skipped []selection.Skipped) error {
+	p := &plan.Plan{Projects: []*plan.Project{}, Skipped: skipped}
+	failed := 0
+	for _, project := range projects {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+		log.Printf("Planning project %s", project.ProjectName)
+		pp, err := planProject(ctx, gitlab_info, templates, syncer, project)
+		if err != nil {
+			log.Printf("Could not plan project %s: %v", project.ProjectName, err)
+			pp.Error = err.Error()
+			failed++
+		}
+		p.Add(pp)
+	}
+
+	if gi.PlanFormat != plan.JSON {
+		reportSkipped(skipped)
+	}
+	if err := plan.Write(os.Stdout, p, gi.PlanFormat); err != nil {
+		return fmt.Errorf("could not write the plan: %v", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not plan %d projects", failed)
+	}
+	return nil
+}
+
+// planProject plans one project, the parts planned before an error are kept
+func planProject(ctx context.Context, gitlab_info *gitlab.GitlabInfo, templates *fileset.Set, syncer *varsync.Syncer, project *gitlab.GitlabResp) (*plan.Project, error) {
+	pp := &plan.Project{Project: project.ProjectPath, Files: []plan.File{}, Variables: []plan.Variable{}}
+	if pp.Project == "" {
+		pp.Project = project.ProjectName
+	}
+
+	files, err := templates.Files(ctx, project)
+	if err != nil {
+		return pp, err
+	}
+	filePlans, err := gitlab_info.PlanFiles(ctx, project, files)
+	if err != nil {
+		return pp, fmt.Errorf("could not read the files: %v", err)
+	}
+	pp.Files = plan.Files(filePlans)
+
+	vars, err := gitlab_info.ListVariables(ctx, project)
+	if err != nil {
+		return pp, fmt.Errorf("could not list variables: %v", err)
+	}
+	pp.Variables = plan.Legacy(gitlab.PlanLegacy(project, vars), syncer.Manages)
+
+	if len(syncer.Mappings) > 0 {
+		varPlans, err := syncer.Plan(ctx, project)
+		if err != nil {
+			return pp, fmt.Errorf("could not plan the vault variables: %v", err)
+		}
+		pp.Variables = append(pp.Variables, plan.Variables(varPlans)...)
+	}
+	return pp, nil
+}
+
+// runMigrate copies the selected plaintext variables of every project into
+// vault and prints what moved
+func runMigrate(ctx context.Context, gi *GitopsInfo, migrator *migrate.Migrator, projects []*gitlab.GitlabResp) {
+	var moves []migrate.Move
+	var errors []error
+	for _, project := range projects {
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("Migrating variables of project %s", project.ProjectName)
+		m, err := migrator.Migrate(ctx, project)
+		moves = append(moves, m...)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("could not migrate variables for project %s: %v", project.ProjectName, err))
+		}
+	}
+
+	if gi.DryRun {
+		fmt.Println("Dry run, nothing was changed:")
+	}
+	migrate.Report(os.Stdout, moves)
+	if len(errors) > 0 {
+		log.Printf("Completed with %d errors:", len(errors))
+		for _, err := range errors {
+			log.Println(err)
 		}
 	}
 }
 
-func validateEnvVars() error {
-	required_only_one := []string{"vault_token", "role_id", "secret_id"}
+// runJwtRoles gives every project a vault jwt role and policy, and reports
+// the roles of projects that are gone. Archived projects are listed too, their
+// roles are not stale. The roles that could not be written are returned as
+// one error.
+func runJwtRoles(ctx context.Context, gitlab_info *gitlab.GitlabInfo, bootstrapper *jwtrole.Bootstrapper, projects []*gitlab.GitlabResp) error {
+	allProjects, err := gitlab_info.ListAllProjects(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list the projects of the jwt roles: %v", err)
+	}
+	log.Printf("Writing the vault jwt roles of %d projects", len(projects))
+	results, err := bootstrapper.Sync(ctx, projects, allProjects)
+	jwtrole.Report(os.Stdout, results)
+	if err != nil {
+		return fmt.Errorf("could not write all the jwt roles: %v", err)
+	}
+	return nil
+}
 
+// interrupted is the error of a run stopped by SIGINT or SIGTERM, nil
+// until then
+func interrupted(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted, the run was stopped before it was done")
+	}
+	return nil
+}
+
+// reportSkipped prints the projects left out by the selection and why
+func reportSkipped(skipped []selection.Skipped) {
+	if len(skipped) == 0 {
+		return
+	}
+	log.Printf("Skipped %d projects:", len(skipped))
+	selection.Report(os.Stdout, skipped)
+}
+
+func validateEnvVars(gi *GitopsInfo) error {
 	if os.Getenv("gitlab_url") == "" {
 		return fmt.Errorf("required environment variable gitlab_url is not set")
 	}
 
-	for _, env := range required_only_one {
-		if os.Getenv(required_only_one[0]) == "" && os.Getenv(required_only_one[1]) == "" || os.Getenv(required_only_one[2]) == "" {
-			return fmt.Errorf("required environment variable %s or approle are not set", env)
+	switch gi.AuthType {
+	case "approle":
+		if os.Getenv("role_id") == "" {
+			return fmt.Errorf("required environment variable role_id is not set")
+		}
+		if os.Getenv("secret_id") == "" && os.Getenv("secret_id_wrapping_token") == "" {
+			return fmt.Errorf("required environment variable secret_id or secret_id_wrapping_token is not set")
+		}
+	case "token":
+		if os.Getenv("vault_token") == "" {
+			return fmt.Errorf("required environment variable vault_token is not set")
+		}
+	case "kubernetes":
+		// the service account token is read from k8s_jwt_path
+	case "jwt":
+		if os.Getenv(gi.JwtEnv) == "" && gi.JwtPath == "" {
+			return fmt.Errorf("required environment variable %s or jwt_path are not set", gi.JwtEnv)
+		}
+	case "age":
+		if gi.AgeFile == "" {
+			return fmt.Errorf("age_file is not set for zone %s", gi.Zone)
 		}
+		if os.Getenv(gi.AgeKeyEnv) == "" && gi.AgeKeyFile == "" {
+			return fmt.Errorf("required environment variable %s or age_key_file are not set", gi.AgeKeyEnv)
+		}
+		// without vault only the gitlab credentials are available
+		if gi.Command == "migrate" || len(gi.Variables) > 0 || gi.DeployKeys.Path != "" || len(gi.JwtRoles.Policy) > 0 || gi.GitlabTokenRole != "" {
+			return fmt.Errorf("migrate, variables, deploy_keys, jwt_roles and gitlab_token_role need vault, they cannot run with auth type age")
+		}
+	default:
+		return fmt.Errorf("unsupported auth type %q", gi.AuthType)
+	}
+
+	if k.Exists("gitlab-ci-content") || k.Exists("gitlab-readme-content") {
+		return fmt.Errorf("gitlab-ci-content and gitlab-readme-content are replaced by the files of templates_dir, move them to %s/.gitlab-ci.yml.tmpl and %s/README.md.tmpl", gi.TemplatesDir, gi.TemplatesDir)
+	}
+
+	if gi.Command == "plan" && gi.PlanFormat != plan.Text && gi.PlanFormat != plan.JSON {
+		return fmt.Errorf("unsupported plan_format %q, want %s or %s", gi.PlanFormat, plan.Text, plan.JSON)
+	}
+
+	switch gi.Delivery {
+	case gitlab.DeliveryPush, gitlab.DeliveryMergeRequest:
+	default:
+		return fmt.Errorf("unsupported delivery %q, want %s or %s", gi.Delivery, gitlab.DeliveryPush, gitlab.DeliveryMergeRequest)
 	}
 	return nil
 }
@@ -222,7 +761,20 @@ func loadConfig() (*GitopsInfo, *ProfilingInfo) {
 	// set command line flags
 	cmd.String("product_line", "stg", "product line to deploy (prd, stg)")
 	cmd.String("cluster_name", "test1", "the cluster name to deploy")
-	cmd.String("auth_type", " ", "the authentication type (vault token or approle)")
+	cmd.String("auth_type", " ", "the authentication type (token, approle, kubernetes, jwt or age)")
+	cmd.String("kubernetes_mount", "kubernetes", "the vault kubernetes auth mount")
+	cmd.String("k8s_role", "gitlab-vault", "the vault kubernetes auth role")
+	cmd.String("k8s_jwt_path", vault.DefaultServiceAccountTokenPath, "the projected service account token path")
+	cmd.String("jwt_mount", "jwt", "the vault jwt auth mount")
+	cmd.String("jwt_role", "gitlab-vault", "the vault jwt auth role")
+	cmd.String("jwt_env", "VAULT_ID_TOKEN", "the environment variable holding the CI id_token")
+	cmd.String("jwt_path", "", "a file holding the JWT, used when jwt_env is empty")
+	cmd.String("age_key_env", vault.DefaultAgeKeyEnv, "the environment variable holding the age key of auth_type age")
+	cmd.String("age_key_file", "", "a file holding the age key, used when age_key_env is empty")
+	cmd.String("delivery", gitlab.DeliveryPush, "push the files to the branch, or merge_request to open a merge request with them")
+	cmd.String("templates_dir", "conf/templates", "the directory of the managed files, laid out like the repositories")
+	cmd.String("plan_format", plan.Text, "plan: the output, text or json")
+	cmd.Bool("dry_run", false, "migrate: only report the variables that would move")
 	cmd.String("cpu_profile", "cpu.pprof", "the cpu profile")
 	cmd.String("mem_profile", "mem.pprof", "the memory profile")
 	cmd.Parse(os.Args[1:])
@@ -238,22 +790,83 @@ func loadConfig() (*GitopsInfo, *ProfilingInfo) {
 		log.Fatalf("error loading config: %v", err)
 	}
 	gi := &GitopsInfo{}
+	var zone string
 	switch k.String("product_line") {
 	case "prd":
-		gi = &GitopsInfo{
-			ProductLine: k.String("product_line"),
-			ClusterName: k.String("cluster_name"),
-			GitlabNs:    k.String("zone.production.gitlab_namespace"),
-			VaultAddr:   k.String("zone.production.vault_addr"),
-			AuthType:    k.String("auth_type"),
-		}
+		zone = "production"
 	case "stg":
+		zone = "development"
+	}
+	if zone != "" {
+		z := "zone." + zone + "."
 		gi = &GitopsInfo{
-			ProductLine: k.String("product_line"),
-			ClusterName: k.String("cluster_name"),
-			GitlabNs:    k.String("zone.development.gitlab_namespace"),
-			VaultAddr:   k.String("zone.development.vault_addr"),
-			AuthType:    k.String("auth_type"),
+			Command:          cmd.Arg(0),
+			DryRun:           k.Bool("dry_run"),
+			ProductLine:      k.String("product_line"),
+			ClusterName:      k.String("cluster_name"),
+			Zone:             zone,
+			GitlabNs:         k.String(z + "gitlab_namespace"),
+			IncludeSubgroups: k.Bool(z + "include_subgroups"),
+			GitlabRateLimit:  k.Float64(z + "gitlab_rate_limit"),
+			Branch:           k.String(z + "default_branch"),
+			CiConfigPath:     k.String(z + "ci_config_path"),
+			Delivery:         k.String("delivery"),
+			PlanFormat:       k.String("plan_format"),
+			TemplatesDir:     k.String("templates_dir"),
+			VaultAddr:        k.String(z + "vault_addr"),
+			KvMount:          k.String(z + "kv_mount"),
+			KvVersion:        k.Int(z + "kv_version"),
+			SecretVersion:    k.Int(z + "secret_version"),
+			GitlabTokenMount: k.String(z + "gitlab_token_mount"),
+			GitlabTokenRole:  k.String(z + "gitlab_token_role"),
+			AgeFile:          k.String(z + "age_file"),
+			AgeKeyEnv:        k.String("age_key_env"),
+			AgeKeyFile:       k.String("age_key_file"),
+			AuthType:         k.String("auth_type"),
+			K8sMount:         k.String("kubernetes_mount"),
+			K8sRole:          k.String("k8s_role"),
+			K8sJwtPath:       k.String("k8s_jwt_path"),
+			JwtMount:         k.String("jwt_mount"),
+			JwtRole:          k.String("jwt_role"),
+			JwtEnv:           k.String("jwt_env"),
+			JwtPath:          k.String("jwt_path"),
+		}
+		if gi.KvMount == "" {
+			gi.KvMount = vault.DefaultKvMount
+		}
+		// namespace applies to both unless they are set on their own
+		gi.AuthNamespace = k.String(z + "namespace")
+		gi.SecretNamespace = k.String(z + "namespace")
+		if k.Exists(z + "auth_namespace") {
+			gi.AuthNamespace = k.String(z + "auth_namespace")
+		}
+		if k.Exists(z + "secret_namespace") {
+			gi.SecretNamespace = k.String(z + "secret_namespace")
+		}
+		if err := k.Unmarshal("variables", &gi.Variables); err != nil {
+			log.Fatalf("error loading variables: %v", err)
+		}
+		if err := k.Unmarshal("migrate", &gi.Migrate); err != nil {
+			log.Fatalf("error loading migrate: %v", err)
+		}
+		if err := k.Unmarshal(z+"projects", &gi.Projects); err != nil {
+			log.Fatalf("error loading projects: %v", err)
+		}
+		if err := k.Unmarshal("deploy_keys", &gi.DeployKeys); err != nil {
+			log.Fatalf("error loading deploy_keys: %v", err)
+		}
+		if err := k.Unmarshal("jwt_roles", &gi.JwtRoles); err != nil {
+			log.Fatalf("error loading jwt_roles: %v", err)
+		}
+		if err := k.Unmarshal("merge_request", &gi.MergeRequest); err != nil {
+			log.Fatalf("error loading merge_request: %v", err)
+		}
+		if err := k.Unmarshal("commit", &gi.Commit); err != nil {
+			log.Fatalf("error loading commit: %v", err)
+		}
+		gi.CiLint.MaxFailureRate = cilint.DefaultMaxFailureRate
+		if err := k.Unmarshal("ci_lint", &gi.CiLint); err != nil {
+			log.Fatalf("error loading ci_lint: %v", err)
 		}
 	}
 
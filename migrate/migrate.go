@@ -0,0 +1,214 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/varsync"
+	"gitlab-vault/vault"
+)
+
+// Source actions applied to the gitlab copy once it is in vault
+const (
+	Keep   = "keep"
+	Mask   = "mask"
+	Delete = "delete"
+)
+
+// refPrefix starts the description of migrated variables, it is how a rerun
+// recognises them
+const refPrefix = "vault:"
+
+type Config struct {
+	// Keys selects the variables to migrate by regex on their key
+	Keys []string `koanf:"keys"`
+	// Path is the <mount>/<path> of the per-project secret, {{project}} and
+	// {{project_id}} are replaced with the full path and the id of each
+	// project
+	Path string `koanf:"path"`
+	// SourceAction is what happens to the gitlab copy: keep, mask or delete
+	SourceAction string `koanf:"source_action"`
+}
+
+// SecretStore reads and writes kv secrets, vault.Lifecycle implements it
+type SecretStore interface {
+	ReadSecret(ctx context.Context, mount, path string) (map[string]interface{}, error)
+	WriteSecret(ctx context.Context, mount, path string, data map[string]interface{}) error
+}
+
+// Move is one variable copied, or to be copied, into vault
+type Move struct {
+	Project          string
+	Key              string
+	EnvironmentScope string
+	// Target is the vault reference, <mount>/<path>#<field>
+	Target string
+	Action string
+	Status string
+}
+
+type Migrator struct {
+	Gitlab  *gitlab.GitlabInfo
+	Secrets SecretStore
+	Config  Config
+	DryRun  bool
+
+	keys []*regexp.Regexp
+}
+
+// Validate compiles the key selectors and checks the target path
+func (m *Migrator) Validate() error {
+	if len(m.Config.Keys) == 0 {
+		return errors.New("migrate.keys selects no variable")
+	}
+	m.keys = nil
+	for _, k := range m.Config.Keys {
+		re, err := regexp.Compile(k)
+		if err != nil {
+			return fmt.Errorf("invalid key selector %q: %v", k, err)
+		}
+		m.keys = append(m.keys, re)
+	}
+	if _, _, _, err := varsync.ParseSource(m.Config.Path + "#field"); err != nil {
+		return fmt.Errorf("invalid migrate.path: %v", err)
+	}
+	switch m.Config.SourceAction {
+	case "":
+		m.Config.SourceAction = Keep
+	case Keep, Mask, Delete:
+	default:
+		return fmt.Errorf("unknown source_action %q, want keep, mask or delete", m.Config.SourceAction)
+	}
+	return nil
+}
+
+func (m *Migrator) selected(key string) bool {
+	for _, re := range m.keys {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// field is the name of the variable in the vault secret, scoped variables
+// get the scope appended so they do not overwrite each other
+func field(key, scope string) string {
+	if scope == "" || scope == "*" {
+		return key
+	}
+	return key + "@" + scope
+}
+
+// Migrate copies the selected variables of a project into its vault secret,
+// then records the reference on the gitlab copy or deletes it. In dry run it
+// only returns what would move.
+func (m *Migrator) Migrate(ctx context.Context, gr *gitlab.GitlabResp) ([]Move, error) {
+	mount, path, _, err := varsync.ParseSource(gr.Expand(m.Config.Path) + "#field")
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := m.Gitlab.ListVariables(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := []Move{}
+	// sources holds the index in vars of each move
+	sources := []int{}
+	data := map[string]interface{}{}
+	for i, v := range vars {
+		if !m.selected(v.Key) {
+			continue
+		}
+		f := field(v.Key, v.EnvironmentScope)
+		move := Move{
+			Project:          gr.ProjectPath,
+			Key:              v.Key,
+			EnvironmentScope: v.EnvironmentScope,
+			Target:           mount + "/" + path + "#" + f,
+			Action:           m.Config.SourceAction,
+			Status:           "pending",
+		}
+		if strings.HasPrefix(v.Description, refPrefix) {
+			move.Status = "already migrated"
+			move.Action = "none"
+		} else if v.Hidden {
+			// hidden values are not returned by the api
+			move.Status = "skipped: hidden value"
+			move.Action = "none"
+		} else {
+			data[f] = v.Value
+		}
+		if m.DryRun && move.Status == "pending" {
+			move.Status = "would move"
+		}
+		moves = append(moves, move)
+		sources = append(sources, i)
+	}
+	if m.DryRun || len(data) == 0 {
+		return moves, nil
+	}
+
+	// keep the fields already in the secret
+	existing, err := m.Secrets.ReadSecret(ctx, mount, path)
+	if err != nil && !errors.Is(err, vault.ErrSecretNotFound) {
+		return moves, fmt.Errorf("could not read %s/%s: %v", mount, path, err)
+	}
+	for k, v := range existing {
+		if _, ok := data[k]; !ok {
+			data[k] = v
+		}
+	}
+	if err := m.Secrets.WriteSecret(ctx, mount, path, data); err != nil {
+		return moves, fmt.Errorf("could not write %s/%s: %v", mount, path, err)
+	}
+
+	var errs []error
+	for i, move := range moves {
+		if move.Status != "pending" {
+			continue
+		}
+		moves[i].Status = "copied"
+
+		src := vars[sources[i]]
+		var err error
+		switch move.Action {
+		case Keep, Mask:
+			err = m.Gitlab.UpdateVariableValue(ctx, gr, &gitlab.GitlabVariable{
+				Key:              move.Key,
+				Value:            src.Value,
+				Masked:           src.Masked || move.Action == Mask,
+				Protected:        src.Protected,
+				EnvironmentScope: move.EnvironmentScope,
+				Description:      refPrefix + move.Target,
+			})
+		case Delete:
+			err = m.Gitlab.DeleteVariable(ctx, gr, move.Key, move.EnvironmentScope)
+		}
+		if err != nil {
+			moves[i].Status = "copied, " + move.Action + " failed"
+			errs = append(errs, fmt.Errorf("could not %s variable %s: %v", move.Action, move.Key, err))
+			continue
+		}
+		moves[i].Status = "migrated"
+	}
+	return moves, errors.Join(errs...)
+}
+
+// Report writes the moves as a table
+func Report(w io.Writer, moves []Move) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tKEY\tSCOPE\tVAULT\tGITLAB COPY\tSTATUS")
+	for _, m := range moves {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", m.Project, m.Key, m.EnvironmentScope, m.Target, m.Action, m.Status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/internal/testutil"
+)
+
+func TestMigrate(t *testing.T) {
+	vars := []map[string]interface{}{
+		{"key": "DB_PASSWORD", "value": "s3cret", "environment_scope": "*"},
+		{"key": "API_TOKEN", "value": "tok", "environment_scope": "production"},
+		{"key": "OLD_TOKEN", "value": "old", "environment_scope": "*", "description": "vault:secret/mor/grp/project1/gitlab#OLD_TOKEN"},
+		{"key": "LOG_LEVEL", "value": "debug", "environment_scope": "*"},
+	}
+	project := &gitlab.GitlabResp{ProjectName: "project1", ProjectPath: "grp/project1", ProjectId: "1"}
+
+	tests := []struct {
+		name       string
+		action     string
+		dryRun     bool
+		wantWrites []string
+		wantStatus string
+	}{
+		{
+			name:       "dry run",
+			action:     Keep,
+			dryRun:     true,
+			wantWrites: []string{},
+			wantStatus: "would move",
+		},
+		{
+			name:   "mask",
+			action: Mask,
+			wantWrites: []string{
+				"update DB_PASSWORD masked=true vault:secret/mor/grp/project1/gitlab#DB_PASSWORD",
+				"update API_TOKEN masked=true vault:secret/mor/grp/project1/gitlab#API_TOKEN@production",
+			},
+			wantStatus: "migrated",
+		},
+		{
+			name:       "delete",
+			action:     Delete,
+			wantWrites: []string{"delete DB_PASSWORD", "delete API_TOKEN"},
+			wantStatus: "migrated",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, writes := testutil.MockVariables(t, vars)
+			store := testutil.NewSecretStore(map[string]map[string]interface{}{
+				"secret/mor/grp/project1/gitlab": {"token": "gitlab"},
+			})
+			m := &Migrator{
+				Gitlab:  &gitlab.GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"},
+				Secrets: store,
+				Config: Config{
+					Keys:         []string{"PASSWORD$", "TOKEN$"},
+					Path:         "secret/mor/{{project}}/gitlab",
+					SourceAction: tt.action,
+				},
+				DryRun: tt.dryRun,
+			}
+			if err := m.Validate(); err != nil {
+				t.Fatalf("Unexpected validation error: %v", err)
+			}
+
+			moves, err := m.Migrate(context.Background(), project)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(moves) != 3 {
+				t.Fatalf("Expected 3 moves but got %d", len(moves))
+			}
+			for _, move := range moves {
+				want := tt.wantStatus
+				if move.Key == "OLD_TOKEN" {
+					want = "already migrated"
+				}
+				if move.Status != want {
+					t.Errorf("%s: expected status %q but got %q", move.Key, want, move.Status)
+				}
+				if move.Project != "grp/project1" {
+					t.Errorf("%s: expected project grp/project1 but got %q", move.Key, move.Project)
+				}
+			}
+			if strings.Join(*writes, "\n") != strings.Join(tt.wantWrites, "\n") {
+				t.Errorf("unexpected gitlab writes:\n%s", strings.Join(*writes, "\n"))
+			}
+
+			secret := store.Secrets["secret/mor/grp/project1/gitlab"]
+			if tt.dryRun {
+				if store.Writes != 0 || len(secret) != 1 {
+					t.Errorf("dry run wrote to vault: %v", secret)
+				}
+				return
+			}
+			if secret["token"] != "gitlab" || secret["DB_PASSWORD"] != "s3cret" || secret["API_TOKEN@production"] != "tok" {
+				t.Errorf("unexpected vault secret: %v", secret)
+			}
+
+			var report bytes.Buffer
+			Report(&report, moves)
+			if !strings.Contains(report.String(), "secret/mor/grp/project1/gitlab#DB_PASSWORD") {
+				t.Errorf("report misses the vault reference:\n%s", report.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package plan
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pmezard/go-difflib/difflib"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/selection"
+	"gitlab-vault/varsync"
+)
+
+// Output formats of Write
+const (
+	Text = "text"
+	JSON = "json"
+)
+
+// File is a managed file of a project, Diff is empty when it is unchanged
+type File struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// Variable is a CI variable of a project, the values are masked
+type Variable struct {
+	Key              string `json:"key"`
+	EnvironmentScope string `json:"environment_scope"`
+	Status           string `json:"status"`
+	Before           string `json:"before"`
+	After            string `json:"after"`
+}
+
+// Project is what a run would change in a project
+type Project struct {
+	Project   string     `json:"project"`
+	Files     []File     `json:"files"`
+	Variables []Variable `json:"variables"`
+	// Error is why the plan of the project is incomplete
+	Error string `json:"error,omitempty"`
+}
+
+// Plan is what a run would change, Changed is false when it would change
+// nothing
+type Plan struct {
+	Changed  bool                `json:"changed"`
+	Projects []*Project          `json:"projects"`
+	Skipped  []selection.Skipped `json:"skipped"`
+}
+
+// Add appends the project to the plan
+func (p *Plan) Add(project *Project) {
+	if project.Changed() {
+		p.Changed = true
+	}
+	p.Projects = append(p.Projects, project)
+}
+
+// Changed reports whether a file or a variable of the project would change
+func (p *Project) Changed() bool {
+	for _, f := range p.Files {
+		if f.Status != gitlab.FileUnchanged {
+			return true
+		}
+	}
+	for _, v := range p.Variables {
+		if v.Status != string(varsync.Unchanged) {
+			return true
+		}
+	}
+	return false
+}
+
+// Files diffs the planned files
+func Files(plans []gitlab.FilePlan) []File {
+	files := []File{}
+	for _, p := range plans {
+		f := File{Path: p.Path, Status: p.Status}
+		if p.Status != gitlab.FileUnchanged {
+			f.Diff = Diff(p.Path, p.Before, p.After, p.Status)
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// Diff is the unified diff of a file, created files come from /dev/null
+// and deleted ones go to it
+func Diff(path, before, after, status string) string {
+	from, to := "a/"+path, "b/"+path
+	switch status {
+	case gitlab.FileCreated:
+		from = "/dev/null"
+	case gitlab.FileDeleted:
+		to = "/dev/null"
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before),
+		B:        difflib.SplitLines(after),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Sprintf("could not diff %s: %v\n", path, err)
+	}
+	return diff
+}
+
+// Variables masks the planned variables of the sync
+func Variables(plans []varsync.Planned) []Variable {
+	vars := []Variable{}
+	for _, p := range plans {
+		vars = append(vars, Variable{
+			Key:              p.Key,
+			EnvironmentScope: p.EnvironmentScope,
+			Status:           string(p.Status),
+			Before:           Mask(p.Before),
+			After:            Mask(p.After),
+		})
+	}
+	return vars
+}
+
+// Legacy masks the values UpdateVariable would give the variables that are
+// not managed by the sync
+func Legacy(plans []gitlab.LegacyPlan, managed func(key, environmentScope string) bool) []Variable {
+	vars := []Variable{}
+	for _, p := range plans {
+		if managed(p.Key, p.EnvironmentScope) {
+			continue
+		}
+		status := varsync.Unchanged
+		if p.After != p.Before {
+			status = varsync.Updated
+		}
+		scope := p.EnvironmentScope
+		if scope == "" {
+			scope = "*"
+		}
+		vars = append(vars, Variable{
+			Key:              p.Key,
+			EnvironmentScope: scope,
+			Status:           string(status),
+			Before:           Mask(p.Before),
+			After:            Mask(p.After),
+		})
+	}
+	return vars
+}
+
+// Mask hides a value, empty values stay empty
+func Mask(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "********"
+}
+
+// Write prints the plan in the format, Text or JSON
+func Write(w io.Writer, p *Plan, format string) error {
+	switch format {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	case Text, "":
+		writeText(w, p)
+		return nil
+	default:
+		return fmt.Errorf("unknown plan format %q, want %s or %s", format, Text, JSON)
+	}
+}
+
+func writeText(w io.Writer, p *Plan) {
+	files, vars, projects := 0, 0, 0
+	for _, project := range p.Projects {
+		if !project.Changed() && project.Error == "" {
+			continue
+		}
+		fmt.Fprintf(w, "Project %s\n", project.Project)
+		if project.Error != "" {
+			fmt.Fprintf(w, "  error: %s\n", project.Error)
+		}
+		for _, f := range project.Files {
+			if f.Status == gitlab.FileUnchanged {
+				continue
+			}
+			files++
+			fmt.Fprintf(w, "  %s: %s\n", f.Path, f.Status)
+			for _, line := range strings.Split(strings.TrimSuffix(f.Diff, "\n"), "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		header := false
+		for _, v := range project.Variables {
+			if v.Status == string(varsync.Unchanged) {
+				continue
+			}
+			if !header {
+				fmt.Fprintln(tw, "  VARIABLE\tSCOPE\tSTATUS\tBEFORE\tAFTER")
+				header = true
+			}
+			vars++
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", v.Key, v.EnvironmentScope, v.Status, orDash(v.Before), orDash(v.After))
+		}
+		tw.Flush()
+		if project.Changed() {
+			projects++
+		}
+	}
+
+	if !p.Changed {
+		fmt.Fprintf(w, "No changes in %d projects.\n", len(p.Projects))
+		return
+	}
+	fmt.Fprintf(w, "Plan: %d files and %d variables to change in %d of %d projects.\n", files, vars, projects, len(p.Projects))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
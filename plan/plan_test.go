@@ -0,0 +1,112 @@
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/selection"
+	"gitlab-vault/varsync"
+)
+
+func testPlan() *Plan {
+	p := &Plan{Projects: []*Project{}, Skipped: []selection.Skipped{{Project: "grp/fork", Reason: "fork"}}}
+	p.Add(&Project{
+		Project: "grp/api",
+		Files: Files([]gitlab.FilePlan{
+			{FileResult: gitlab.FileResult{Path: ".gitlab-ci.yml", Status: gitlab.FileUpdated}, Before: "stages:\n  - build\n", After: "stages:\n  - build\n  - deploy\n"},
+			{FileResult: gitlab.FileResult{Path: "README.md", Status: gitlab.FileUnchanged}, Before: "# api\n", After: "# api\n"},
+		}),
+		Variables: append(
+			Legacy([]gitlab.LegacyPlan{
+				{Key: "PROJECT", Before: "7", After: "7"},
+				{Key: "DB_PASSWORD", Before: "old", After: "7"},
+			}, func(key, environmentScope string) bool { return key == "DB_PASSWORD" }),
+			Variables([]varsync.Planned{
+				{Change: varsync.Change{Key: "DB_PASSWORD", EnvironmentScope: "*", Status: varsync.Updated}, Before: "old", After: "s3cret"},
+			})...,
+		),
+	})
+	p.Add(&Project{
+		Project:   "grp/web",
+		Files:     Files([]gitlab.FilePlan{{FileResult: gitlab.FileResult{Path: "README.md", Status: gitlab.FileUnchanged}}}),
+		Variables: []Variable{},
+	})
+	return p
+}
+
+func TestWriteText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testPlan(), Text); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"Project grp/api\n",
+		"  .gitlab-ci.yml: updated\n",
+		"    --- a/.gitlab-ci.yml\n",
+		"    +++ b/.gitlab-ci.yml\n",
+		"    +  - deploy\n",
+		"DB_PASSWORD",
+		"Plan: 1 files and 1 variables to change in 1 of 2 projects.\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in the plan:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"s3cret", "old", "grp/web", "README.md", "PROJECT"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("Unexpected %q in the plan:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testPlan(), JSON); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if strings.Contains(buf.String(), "s3cret") {
+		t.Errorf("Expected masked values, got:\n%s", buf.String())
+	}
+
+	var got Plan
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid json: %v", err)
+	}
+	if !got.Changed || len(got.Projects) != 2 || len(got.Skipped) != 1 {
+		t.Errorf("Unexpected plan %+v", got)
+	}
+	vars := got.Projects[0].Variables
+	if len(vars) != 2 || vars[0].Key != "PROJECT" || vars[0].Status != "unchanged" || vars[1].Before != Mask("old") {
+		t.Errorf("Unexpected variables %+v", vars)
+	}
+}
+
+func TestNoChanges(t *testing.T) {
+	p := &Plan{}
+	p.Add(&Project{Project: "grp/web", Files: Files([]gitlab.FilePlan{{FileResult: gitlab.FileResult{Path: "README.md", Status: gitlab.FileUnchanged}}})})
+	var buf bytes.Buffer
+	if err := Write(&buf, p, Text); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if p.Changed || buf.String() != "No changes in 1 projects.\n" {
+		t.Errorf("Expected no changes, got %v:\n%s", p.Changed, buf.String())
+	}
+	if err := Write(&buf, p, "yaml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestDiffCreatedAndDeleted(t *testing.T) {
+	created := Diff("ci.yml", "", "a: 1\n", gitlab.FileCreated)
+	if !strings.HasPrefix(created, "--- /dev/null\n+++ b/ci.yml\n") || !strings.Contains(created, "+a: 1\n") {
+		t.Errorf("Unexpected diff of a created file:\n%s", created)
+	}
+	deleted := Diff("ci.yml", "a: 1\n", "", gitlab.FileDeleted)
+	if !strings.HasPrefix(deleted, "--- a/ci.yml\n+++ /dev/null\n") || !strings.Contains(deleted, "-a: 1\n") {
+		t.Errorf("Unexpected diff of a deleted file:\n%s", deleted)
+	}
+}
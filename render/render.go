@@ -0,0 +1,121 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"gitlab-vault/gitlab"
+)
+
+// Engine renders the managed files of every project with the same data and
+// functions. A key missing from the data is an error, not "<no value>".
+type Engine struct {
+	Zone        string
+	ClusterName string
+	ProductLine string
+}
+
+// Template is a parsed managed file template
+type Template struct {
+	engine *Engine
+	tpl    *template.Template
+}
+
+// Parse parses a template, name shows in the errors
+func (e *Engine) Parse(name, content string) (*Template, error) {
+	tpl, err := template.New(name).Option("missingkey=error").Funcs(Funcs()).Parse(content)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{engine: e, tpl: tpl}, nil
+}
+
+// Data is what the templates see for a project
+func (e *Engine) Data(gr *gitlab.GitlabResp) map[string]interface{} {
+	topics := gr.Topics
+	if topics == nil {
+		topics = []string{}
+	}
+	return map[string]interface{}{
+		"ProjectName":   gr.ProjectName,
+		"ProjectId":     gr.ProjectId,
+		"ProjectPath":   gr.ProjectPath,
+		"Namespace":     gr.NamespacePath,
+		"DefaultBranch": gr.DefaultBranch,
+		"Topics":        topics,
+		"Visibility":    gr.Visibility,
+		"Zone":          e.Zone,
+		"ClusterName":   e.ClusterName,
+		"ProductLine":   e.ProductLine,
+	}
+}
+
+// Render executes the template for a project
+func (t *Template) Render(gr *gitlab.GitlabResp) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tpl.Execute(&buf, t.engine.Data(gr)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var slugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Funcs is the helper library of the templates
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"lower":     strings.ToLower,
+		"upper":     strings.ToUpper,
+		"trim":      strings.TrimSpace,
+		"replace":   func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+		"split":     func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":      func(sep string, elems []string) string { return strings.Join(elems, sep) },
+		"has":       func(elem string, list []string) bool { return slices.Contains(list, elem) },
+		"quote":     func(s string) string { return fmt.Sprintf("%q", s) },
+		// slug is the CI_PROJECT_PATH_SLUG form of a path
+		"slug": func(s string) string {
+			return strings.Trim(slugInvalid.ReplaceAllString(strings.ToLower(s), "-"), "-")
+		},
+		"default": func(def, value interface{}) interface{} {
+			if value == nil || value == "" {
+				return def
+			}
+			return value
+		},
+		"required": func(msg string, value interface{}) (interface{}, error) {
+			if value == nil || value == "" {
+				return nil, errors.New(msg)
+			}
+			return value, nil
+		},
+		"indent": indent,
+		"nindent": func(spaces int, s string) string {
+			return "\n" + indent(spaces, s)
+		},
+		"toYaml": func(v interface{}) (string, error) {
+			out, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(out), "\n"), err
+		},
+		"toJson": func(v interface{}) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+	}
+}
+
+// indent prefixes every line of s with spaces
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
@@ -0,0 +1,96 @@
+package render
+
+import (
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+)
+
+var project = &gitlab.GitlabResp{
+	ProjectName:   "API",
+	ProjectId:     "42",
+	ProjectPath:   "grp/sub/API",
+	NamespacePath: "grp/sub",
+	DefaultBranch: "develop",
+	Topics:        []string{"go", "backend"},
+	Visibility:    "private",
+}
+
+func TestRender(t *testing.T) {
+	e := &Engine{Zone: "production", ClusterName: "c1", ProductLine: "prd"}
+	tpl, err := e.Parse("ci", `variables:
+  PROJECT_ID: {{ .ProjectId | quote }}
+  SLUG: {{ slug .ProjectPath }}
+  NAMESPACE: {{ .Namespace }}
+  BRANCH: {{ .DefaultBranch }}
+  ZONE: {{ .Zone }}/{{ .ClusterName }}/{{ .ProductLine | upper }}
+  TOPICS: {{ join "," .Topics }}
+{{- if has "go" .Topics }}
+  LANG: go
+{{- end }}
+  TOPIC_LIST: {{ .Topics | toYaml | nindent 4 }}
+`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	got, err := tpl.Render(project)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	want := `variables:
+  PROJECT_ID: "42"
+  SLUG: grp-sub-api
+  NAMESPACE: grp/sub
+  BRANCH: develop
+  ZONE: production/c1/PRD
+  TOPICS: go,backend
+  LANG: go
+  TOPIC_LIST: 
+    - go
+    - backend
+`
+	if got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRenderMissingKey(t *testing.T) {
+	e := &Engine{}
+	tpl, err := e.Parse("readme", "# {{ .ProjectNmae }}\n")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	out, err := tpl.Render(project)
+	if err == nil || !strings.Contains(err.Error(), "ProjectNmae") {
+		t.Errorf("Expected an error naming the missing key, got %q, %v", out, err)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	e := &Engine{}
+	tpl, err := e.Parse("ci", `{{ .DefaultBranch | default "main" }}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got, err := tpl.Render(&gitlab.GitlabResp{}); err != nil || got != "main" {
+		t.Errorf("Expected main, got %q, %v", got, err)
+	}
+	if _, err := e.Parse("ci", `{{ dict }}`); err == nil {
+		t.Error("Expected an error for an undefined function")
+	}
+}
+
+func TestRequired(t *testing.T) {
+	e := &Engine{}
+	tpl, err := e.Parse("ci", `{{ required "the project has no default branch" .DefaultBranch }}`)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if _, err := tpl.Render(&gitlab.GitlabResp{}); err == nil || !strings.Contains(err.Error(), "no default branch") {
+		t.Errorf("Expected the required error, got %v", err)
+	}
+	if got, err := tpl.Render(project); err != nil || got != "develop" {
+		t.Errorf("Expected develop, got %q, %v", got, err)
+	}
+}
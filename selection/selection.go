@@ -0,0 +1,166 @@
+package selection
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab-vault/gitlab"
+)
+
+// Config selects the projects of a zone, or of a managed file with the yaml
+// tags, an empty config keeps them all
+type Config struct {
+	// Include and Exclude are regexes on the full project path, a project
+	// must match one include, when there are any, and no exclude
+	Include []string `koanf:"include" yaml:"include"`
+	Exclude []string `koanf:"exclude" yaml:"exclude"`
+	// Topics keeps the projects with one of the topics, ExcludeTopics skips
+	// the projects with any of them
+	Topics        []string `koanf:"topics" yaml:"topics"`
+	ExcludeTopics []string `koanf:"exclude_topics" yaml:"exclude_topics"`
+	// Labels keeps the projects defining one of the labels, it costs a call
+	// per project so it is checked last
+	Labels []string `koanf:"labels" yaml:"labels"`
+	// Visibility keeps the projects with one of the visibilities: public,
+	// internal or private
+	Visibility  []string `koanf:"visibility" yaml:"visibility"`
+	SkipForks   bool     `koanf:"skip_forks" yaml:"skip_forks"`
+	SkipMirrors bool     `koanf:"skip_mirrors" yaml:"skip_mirrors"`
+	SkipEmpty   bool     `koanf:"skip_empty" yaml:"skip_empty"`
+}
+
+// LabelLister lists the labels of a project, gitlab.GitlabInfo implements it
+type LabelLister interface {
+	ListProjectLabels(ctx context.Context, gr *gitlab.GitlabResp) ([]string, error)
+}
+
+// Skipped is a project left out and why
+type Skipped struct {
+	Project string `json:"project"`
+	Reason  string `json:"reason"`
+}
+
+type Selector struct {
+	Labels LabelLister
+	Config Config
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Validate compiles the regexes and checks the visibilities
+func (s *Selector) Validate() error {
+	var err error
+	if s.include, err = compile(s.Config.Include); err != nil {
+		return err
+	}
+	if s.exclude, err = compile(s.Config.Exclude); err != nil {
+		return err
+	}
+	for _, v := range s.Config.Visibility {
+		switch v {
+		case "public", "internal", "private":
+		default:
+			return fmt.Errorf("unknown visibility %q, want public, internal or private", v)
+		}
+	}
+	if len(s.Config.Labels) > 0 && s.Labels == nil {
+		return fmt.Errorf("label filters need a label lister")
+	}
+	return nil
+}
+
+func compile(exprs []string) ([]*regexp.Regexp, error) {
+	res := []*regexp.Regexp{}
+	for _, e := range exprs {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project selector %q: %v", e, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Select splits the projects into the selected ones and the skipped ones
+func (s *Selector) Select(ctx context.Context, projects []*gitlab.GitlabResp) ([]*gitlab.GitlabResp, []Skipped) {
+	selected := []*gitlab.GitlabResp{}
+	skipped := []Skipped{}
+	for _, gr := range projects {
+		reason, err := s.reason(ctx, gr)
+		if err != nil {
+			reason = err.Error()
+		}
+		if reason != "" {
+			skipped = append(skipped, Skipped{Project: gr.Path(), Reason: reason})
+			continue
+		}
+		selected = append(selected, gr)
+	}
+	return selected, skipped
+}
+
+// Selects reports whether the project is selected, an error when its labels
+// could not be listed
+func (s *Selector) Selects(ctx context.Context, gr *gitlab.GitlabResp) (bool, error) {
+	reason, err := s.reason(ctx, gr)
+	return reason == "" && err == nil, err
+}
+
+// reason returns why the project is skipped, empty when it is selected
+func (s *Selector) reason(ctx context.Context, gr *gitlab.GitlabResp) (string, error) {
+	p := gr.Path()
+	if len(s.include) > 0 && !slices.ContainsFunc(s.include, func(re *regexp.Regexp) bool { return re.MatchString(p) }) {
+		return "path matches no include", nil
+	}
+	for _, re := range s.exclude {
+		if re.MatchString(p) {
+			return fmt.Sprintf("path matches exclude %q", re.String()), nil
+		}
+	}
+	if len(s.Config.Topics) > 0 && !slices.ContainsFunc(gr.Topics, func(t string) bool { return slices.Contains(s.Config.Topics, t) }) {
+		return "has none of the topics " + strings.Join(s.Config.Topics, ", "), nil
+	}
+	for _, t := range gr.Topics {
+		if slices.Contains(s.Config.ExcludeTopics, t) {
+			return fmt.Sprintf("has the excluded topic %s", t), nil
+		}
+	}
+	if len(s.Config.Visibility) > 0 && !slices.Contains(s.Config.Visibility, gr.Visibility) {
+		return fmt.Sprintf("visibility %s", gr.Visibility), nil
+	}
+	if s.Config.SkipForks && gr.Fork {
+		return "fork", nil
+	}
+	if s.Config.SkipMirrors && gr.Mirror {
+		return "mirror", nil
+	}
+	if s.Config.SkipEmpty && gr.EmptyRepo {
+		return "empty repository", nil
+	}
+	if len(s.Config.Labels) > 0 {
+		labels, err := s.Labels.ListProjectLabels(ctx, gr)
+		if err != nil {
+			return "", fmt.Errorf("could not list labels: %v", err)
+		}
+		if !slices.ContainsFunc(labels, func(l string) bool { return slices.Contains(s.Config.Labels, l) }) {
+			return "has none of the labels " + strings.Join(s.Config.Labels, ", "), nil
+		}
+	}
+	return "", nil
+}
+
+// Report writes the skipped projects as a table
+func Report(w io.Writer, skipped []Skipped) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SKIPPED PROJECT\tREASON")
+	for _, s := range skipped {
+		fmt.Fprintf(tw, "%s\t%s\n", s.Project, s.Reason)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,117 @@
+package selection
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab-vault/gitlab"
+)
+
+type fakeLabels map[string][]string
+
+func (f fakeLabels) ListProjectLabels(ctx context.Context, gr *gitlab.GitlabResp) ([]string, error) {
+	labels, ok := f[gr.ProjectId]
+	if !ok {
+		return nil, errors.New("403 Forbidden")
+	}
+	return labels, nil
+}
+
+func TestSelect(t *testing.T) {
+	projects := []*gitlab.GitlabResp{
+		{ProjectId: "1", ProjectPath: "grp/api", Topics: []string{"go"}, Visibility: "private"},
+		{ProjectId: "2", ProjectPath: "grp/sandbox/try", Topics: []string{"go"}, Visibility: "private"},
+		{ProjectId: "3", ProjectPath: "grp/web", Topics: []string{"js"}, Visibility: "private"},
+		{ProjectId: "4", ProjectPath: "grp/old", Topics: []string{"go", "legacy"}, Visibility: "private"},
+		{ProjectId: "5", ProjectPath: "grp/site", Topics: []string{"go"}, Visibility: "public"},
+		{ProjectId: "6", ProjectPath: "grp/fork", Topics: []string{"go"}, Visibility: "private", Fork: true},
+		{ProjectId: "7", ProjectPath: "grp/mirror", Topics: []string{"go"}, Visibility: "private", Mirror: true},
+		{ProjectId: "8", ProjectPath: "grp/empty", Topics: []string{"go"}, Visibility: "private", EmptyRepo: true},
+		{ProjectId: "9", ProjectPath: "grp/nolabel", Topics: []string{"go"}, Visibility: "private"},
+		{ProjectId: "10", ProjectPath: "grp/denied", Topics: []string{"go"}, Visibility: "private"},
+		{ProjectId: "11", ProjectPath: "other/api", Topics: []string{"go"}, Visibility: "private"},
+	}
+	s := &Selector{
+		Labels: fakeLabels{"1": {"managed", "bug"}, "9": {"bug"}},
+		Config: Config{
+			Include:       []string{"^grp/"},
+			Exclude:       []string{"/sandbox/"},
+			Topics:        []string{"go"},
+			ExcludeTopics: []string{"legacy"},
+			Labels:        []string{"managed"},
+			Visibility:    []string{"private", "internal"},
+			SkipForks:     true,
+			SkipMirrors:   true,
+			SkipEmpty:     true,
+		},
+	}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	selected, skipped := s.Select(context.Background(), projects)
+	if len(selected) != 1 || selected[0].ProjectId != "1" {
+		t.Errorf("Expected only grp/api, got %v", selected)
+	}
+	want := []Skipped{
+		{Project: "grp/sandbox/try", Reason: `path matches exclude "/sandbox/"`},
+		{Project: "grp/web", Reason: "has none of the topics go"},
+		{Project: "grp/old", Reason: "has the excluded topic legacy"},
+		{Project: "grp/site", Reason: "visibility public"},
+		{Project: "grp/fork", Reason: "fork"},
+		{Project: "grp/mirror", Reason: "mirror"},
+		{Project: "grp/empty", Reason: "empty repository"},
+		{Project: "grp/nolabel", Reason: "has none of the labels managed"},
+		{Project: "grp/denied", Reason: "could not list labels: 403 Forbidden"},
+		{Project: "other/api", Reason: "path matches no include"},
+	}
+	if !reflect.DeepEqual(skipped, want) {
+		t.Errorf("Expected skipped:\n%v\ngot:\n%v", want, skipped)
+	}
+
+	var buf bytes.Buffer
+	Report(&buf, skipped)
+	if !strings.Contains(buf.String(), "grp/fork") {
+		t.Errorf("Expected the skipped projects in the report, got:\n%s", buf.String())
+	}
+}
+
+func TestSelectsLabelError(t *testing.T) {
+	s := &Selector{Labels: fakeLabels{}, Config: Config{Labels: []string{"managed"}}}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	selected, err := s.Selects(context.Background(), &gitlab.GitlabResp{ProjectId: "1", ProjectPath: "grp/api"})
+	if err == nil || selected {
+		t.Errorf("Expected the label error, got selected=%v err=%v", selected, err)
+	}
+}
+
+func TestSelectAll(t *testing.T) {
+	s := &Selector{}
+	if err := s.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	projects := []*gitlab.GitlabResp{{ProjectId: "1", ProjectName: "a", Fork: true, EmptyRepo: true}}
+	selected, skipped := s.Select(context.Background(), projects)
+	if len(selected) != 1 || len(skipped) != 0 {
+		t.Errorf("Expected an empty config to keep every project, got %v skipped %v", selected, skipped)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Config{
+		{Include: []string{"("}},
+		{Visibility: []string{"secret"}},
+		{Labels: []string{"managed"}},
+	} {
+		s := &Selector{Config: c}
+		if err := s.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", c)
+		}
+	}
+}
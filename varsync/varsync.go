@@ -0,0 +1,222 @@
+package varsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gitlab-vault/gitlab"
+)
+
+// Mapping maps a field of a vault kv secret to a gitlab CI variable
+type Mapping struct {
+	// Source is <mount>/<path>#<field>, {{project}} and {{project_id}} in the
+	// path are replaced with the full path and the id of each project, e.g.
+	// secret/mor/{{project}}/db#password
+	Source           string `koanf:"source"`
+	Key              string `koanf:"key"`
+	Masked           bool   `koanf:"masked"`
+	Protected        bool   `koanf:"protected"`
+	EnvironmentScope string `koanf:"environment_scope"`
+}
+
+// SecretReader reads a kv secret, vault.Lifecycle implements it
+type SecretReader interface {
+	ReadSecret(ctx context.Context, mount, path string) (map[string]interface{}, error)
+}
+
+type Status string
+
+const (
+	Created   Status = "created"
+	Updated   Status = "updated"
+	Unchanged Status = "unchanged"
+)
+
+// Change is the outcome of the sync of one variable
+type Change struct {
+	Key              string
+	EnvironmentScope string
+	Status           Status
+}
+
+type Syncer struct {
+	Gitlab   *gitlab.GitlabInfo
+	Secrets  SecretReader
+	Mappings []Mapping
+}
+
+// ParseSource splits a mapping source into the kv mount, the secret path and
+// the field. The mount is the first path segment.
+func ParseSource(source string) (mount, path, field string, err error) {
+	ref, field, ok := strings.Cut(source, "#")
+	if !ok || field == "" {
+		return "", "", "", fmt.Errorf("source %q has no #field", source)
+	}
+	mount, path, ok = strings.Cut(strings.Trim(ref, "/"), "/")
+	if !ok || mount == "" || path == "" {
+		return "", "", "", fmt.Errorf("source %q is not <mount>/<path>#<field>", source)
+	}
+	return mount, path, field, nil
+}
+
+// Validate checks the mappings before any project is processed
+func (s *Syncer) Validate() error {
+	seen := map[string]bool{}
+	for _, m := range s.Mappings {
+		if m.Key == "" {
+			return fmt.Errorf("mapping for %q has no key", m.Source)
+		}
+		if _, _, _, err := ParseSource(m.Source); err != nil {
+			return err
+		}
+		id := m.Key + "/" + scope(m.EnvironmentScope)
+		if seen[id] {
+			return fmt.Errorf("variable %s is mapped twice for scope %s", m.Key, scope(m.EnvironmentScope))
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Manages reports whether the variable of the key and environment scope is
+// set by a mapping, an empty scope is "*"
+func (s *Syncer) Manages(key, environmentScope string) bool {
+	for _, m := range s.Mappings {
+		if m.Key == key && scope(m.EnvironmentScope) == scope(environmentScope) {
+			return true
+		}
+	}
+	return false
+}
+
+// Desired resolves the mappings for a project, each secret is read once
+func (s *Syncer) Desired(ctx context.Context, gr *gitlab.GitlabResp) ([]*gitlab.GitlabVariable, error) {
+	secrets := map[string]map[string]interface{}{}
+
+	vars := []*gitlab.GitlabVariable{}
+	for _, m := range s.Mappings {
+		mount, path, field, err := ParseSource(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		path = gr.Expand(path)
+
+		data, ok := secrets[mount+"/"+path]
+		if !ok {
+			data, err = s.Secrets.ReadSecret(ctx, mount, path)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s/%s: %v", mount, path, err)
+			}
+			secrets[mount+"/"+path] = data
+		}
+
+		value, ok := data[field]
+		if !ok || value == nil {
+			return nil, fmt.Errorf("secret %s/%s has no field %s", mount, path, field)
+		}
+		vars = append(vars, &gitlab.GitlabVariable{
+			Key:              m.Key,
+			Value:            fmt.Sprint(value),
+			Masked:           m.Masked,
+			Protected:        m.Protected,
+			EnvironmentScope: m.EnvironmentScope,
+		})
+	}
+	return vars, nil
+}
+
+// Planned is a change Sync makes, with the values before and after.
+// Before is empty for created variables.
+type Planned struct {
+	Change
+	Before string
+	After  string
+
+	variable *gitlab.GitlabVariable
+}
+
+// Plan compares the mappings with the variables of the project without
+// changing anything
+func (s *Syncer) Plan(ctx context.Context, gr *gitlab.GitlabResp) ([]Planned, error) {
+	desired, err := s.Desired(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.Gitlab.ListVariables(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+
+	plans := []Planned{}
+	for _, v := range desired {
+		p := Planned{
+			Change:   Change{Key: v.Key, EnvironmentScope: scope(v.EnvironmentScope), Status: Unchanged},
+			After:    v.Value,
+			variable: v,
+		}
+
+		var current *variable
+		for _, e := range existing {
+			if e.Key == v.Key && scope(e.EnvironmentScope) == p.EnvironmentScope {
+				current = &variable{Value: e.Value, Masked: e.Masked, Protected: e.Protected}
+				break
+			}
+		}
+
+		switch {
+		case current == nil:
+			p.Status = Created
+		case current.Value != v.Value || current.Masked != v.Masked || current.Protected != v.Protected:
+			p.Before = current.Value
+			p.Status = Updated
+		default:
+			p.Before = current.Value
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+// Sync creates the missing variables and updates the ones whose value or
+// flags differ from vault, the others are left untouched
+func (s *Syncer) Sync(ctx context.Context, gr *gitlab.GitlabResp) ([]Change, error) {
+	plans, err := s.Plan(ctx, gr)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	var errs []error
+	for _, p := range plans {
+		switch p.Status {
+		case Created:
+			if err := s.Gitlab.CreateVariable(ctx, gr, p.variable); err != nil {
+				errs = append(errs, fmt.Errorf("could not create variable %s: %v", p.Key, err))
+				continue
+			}
+		case Updated:
+			if err := s.Gitlab.UpdateVariableValue(ctx, gr, p.variable); err != nil {
+				errs = append(errs, fmt.Errorf("could not update variable %s: %v", p.Key, err))
+				continue
+			}
+		}
+		changes = append(changes, p.Change)
+	}
+	return changes, errors.Join(errs...)
+}
+
+// variable is the part of a gitlab variable the sync compares
+type variable struct {
+	Value     string
+	Masked    bool
+	Protected bool
+}
+
+func scope(s string) string {
+	if s == "" {
+		return "*"
+	}
+	return s
+}
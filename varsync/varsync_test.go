@@ -0,0 +1,144 @@
+package varsync
+
+import (
+	"context"
+	"testing"
+
+	"gitlab-vault/gitlab"
+	"gitlab-vault/internal/testutil"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		source             string
+		mount, path, field string
+		wantErr            bool
+	}{
+		{source: "secret/mor/{{project}}/db#password", mount: "secret", path: "mor/{{project}}/db", field: "password"},
+		{source: "/kv/app#token", mount: "kv", path: "app", field: "token"},
+		{source: "secret/mor/db", wantErr: true},
+		{source: "secret#password", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			mount, path, field, err := ParseSource(tt.source)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mount != tt.mount || path != tt.path || field != tt.field {
+				t.Errorf("got %s %s %s, want %s %s %s", mount, path, field, tt.mount, tt.path, tt.field)
+			}
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	server, writes := testutil.MockVariables(t, []map[string]interface{}{
+		{"key": "DB_PASSWORD", "value": "s3cret", "masked": true, "protected": true, "environment_scope": "*"},
+		{"key": "DB_USER", "value": "old", "masked": false, "protected": false, "environment_scope": "*"},
+	})
+
+	syncer := &Syncer{
+		Gitlab: &gitlab.GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"},
+		Secrets: testutil.NewSecretStore(map[string]map[string]interface{}{
+			"secret/mor/grp/project1/db": {"password": "s3cret", "user": "app"},
+			"secret/mor/shared":          {"token": "abc"},
+		}),
+		Mappings: []Mapping{
+			{Source: "secret/mor/{{project}}/db#password", Key: "DB_PASSWORD", Masked: true, Protected: true},
+			{Source: "secret/mor/{{project}}/db#user", Key: "DB_USER"},
+			{Source: "secret/mor/shared#token", Key: "SHARED_TOKEN", Masked: true},
+		},
+	}
+	if err := syncer.Validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %v", err)
+	}
+
+	changes, err := syncer.Sync(context.Background(), &gitlab.GitlabResp{ProjectName: "project1", ProjectPath: "grp/project1", ProjectId: "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	want := map[string]Status{"DB_PASSWORD": Unchanged, "DB_USER": Updated, "SHARED_TOKEN": Created}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes but got %d", len(want), len(changes))
+	}
+	for _, c := range changes {
+		if want[c.Key] != c.Status {
+			t.Errorf("variable %s: expected %s but got %s", c.Key, want[c.Key], c.Status)
+		}
+	}
+	if len(*writes) != 2 || (*writes)[0] != "update DB_USER masked=false" || (*writes)[1] != "create SHARED_TOKEN" {
+		t.Errorf("unexpected writes: %v", *writes)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	server, writes := testutil.MockVariables(t, []map[string]interface{}{
+		{"key": "DB_USER", "value": "old", "masked": false, "protected": false, "environment_scope": "*"},
+	})
+	syncer := &Syncer{
+		Gitlab:  &gitlab.GitlabInfo{Token: "valid-token", BaseURL: server.URL + "/api/v4"},
+		Secrets: testutil.NewSecretStore(map[string]map[string]interface{}{"secret/mor/grp/project1/db": {"password": "s3cret", "user": "app"}}),
+		Mappings: []Mapping{
+			{Source: "secret/mor/{{project}}/db#password", Key: "DB_PASSWORD", Masked: true},
+			{Source: "secret/mor/{{project}}/db#user", Key: "DB_USER"},
+		},
+	}
+
+	plans, err := syncer.Plan(context.Background(), &gitlab.GitlabResp{ProjectName: "project1", ProjectPath: "grp/project1", ProjectId: "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(plans) != 2 {
+		t.Fatalf("Expected 2 plans but got %d", len(plans))
+	}
+	if p := plans[0]; p.Status != Created || p.Before != "" || p.After != "s3cret" {
+		t.Errorf("unexpected plan for DB_PASSWORD: %+v", p)
+	}
+	if p := plans[1]; p.Status != Updated || p.Before != "old" || p.After != "app" {
+		t.Errorf("unexpected plan for DB_USER: %+v", p)
+	}
+	if len(*writes) != 0 {
+		t.Errorf("Expected no writes, got %v", *writes)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	syncer := &Syncer{Mappings: []Mapping{
+		{Source: "secret/a#x", Key: "A"},
+		{Source: "secret/b#x", Key: "A"},
+	}}
+	if err := syncer.Validate(); err == nil {
+		t.Error("Expected error for a key mapped twice")
+	}
+}
+
+func TestManages(t *testing.T) {
+	syncer := &Syncer{Mappings: []Mapping{
+		{Source: "secret/a#x", Key: "A"},
+		{Source: "secret/b#x", Key: "B", EnvironmentScope: "production"},
+	}}
+	tests := []struct {
+		key, scope string
+		want       bool
+	}{
+		{"A", "", true},
+		{"A", "*", true},
+		{"A", "production", false},
+		{"B", "production", true},
+		{"B", "*", false},
+		{"C", "*", false},
+	}
+	for _, tt := range tests {
+		if got := syncer.Manages(tt.key, tt.scope); got != tt.want {
+			t.Errorf("Manages(%s, %q): expected %v, got %v", tt.key, tt.scope, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault-client-go"
+)
+
+// The calls below manage policies and auth roles, they run in the auth
+// namespace where the auth mounts live and need a token allowed on
+// sys/policies/acl and auth/<mount>/role.
+
+// WritePolicy creates or replaces the ACL policy name
+func (l *Lifecycle) WritePolicy(ctx context.Context, name, policy string) error {
+	client := l.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+	_, err := l.tokenClient(client).Write(ctx, "/sys/policies/acl/"+name, map[string]interface{}{
+		"policy": policy,
+	})
+	return err
+}
+
+func (l *Lifecycle) DeletePolicy(ctx context.Context, name string) error {
+	client := l.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+	_, err := l.tokenClient(client).Delete(ctx, "/sys/policies/acl/"+name)
+	return err
+}
+
+// WriteJwtRole creates or replaces the role name of the jwt auth mount
+func (l *Lifecycle) WriteJwtRole(ctx context.Context, mount, name string, role map[string]interface{}) error {
+	client := l.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+	_, err := l.tokenClient(client).Write(ctx, "/auth/"+strings.Trim(mount, "/")+"/role/"+name, role)
+	return err
+}
+
+// ListJwtRoles returns the role names of the jwt auth mount
+func (l *Lifecycle) ListJwtRoles(ctx context.Context, mount string) ([]string, error) {
+	client := l.Client()
+	if client == nil {
+		return nil, errors.New("vault lifecycle is not started")
+	}
+	resp, err := l.tokenClient(client).List(ctx, "/auth/"+strings.Trim(mount, "/")+"/role")
+	if vault.IsErrorStatus(err, http.StatusNotFound) {
+		// no role yet
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := resp.Data["keys"].([]interface{})
+	roles := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if s, ok := k.(string); ok {
+			roles = append(roles, s)
+		}
+	}
+	return roles, nil
+}
+
+func (l *Lifecycle) DeleteJwtRole(ctx context.Context, mount, name string) error {
+	client := l.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+	_, err := l.tokenClient(client).Delete(ctx, "/auth/"+strings.Trim(mount, "/")+"/role/"+name)
+	return err
+}
@@ -0,0 +1,98 @@
+package vault
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultAgeKeyEnv is the environment variable holding the age identity, the
+// one sops reads too
+const DefaultAgeKeyEnv = "SOPS_AGE_KEY"
+
+// CredsAgeFile reads the gitlab credentials from a local age encrypted yaml
+// file instead of vault, for labs without one. The decrypted file is the
+// token map, e.g. `token: glpat-...`.
+type CredsAgeFile struct {
+	file string
+	// keyEnv holds the age identities, keyFile is read when it is empty
+	keyEnv  string
+	keyFile string
+}
+
+// NewCredsAgeFile reads file with the identities of the keyEnv environment
+// variable, or of keyFile. An empty keyEnv uses DefaultAgeKeyEnv.
+func NewCredsAgeFile(file, keyEnv, keyFile string) *CredsAgeFile {
+	if keyEnv == "" {
+		keyEnv = DefaultAgeKeyEnv
+	}
+	return &CredsAgeFile{
+		file:    file,
+		keyEnv:  keyEnv,
+		keyFile: keyFile,
+	}
+}
+
+func (c *CredsAgeFile) identities() ([]age.Identity, error) {
+	if key := os.Getenv(c.keyEnv); key != "" {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+	if c.keyFile == "" {
+		return nil, fmt.Errorf("no age key: %s and the key file are not set", c.keyEnv)
+	}
+	f, err := os.Open(c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+func (c *CredsAgeFile) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	identities, err := c.identities()
+	if err != nil {
+		log.Println("Could not read the age key")
+		return nil, err
+	}
+
+	f, err := os.Open(c.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the file may be armored, like `age -a` writes it
+	var in io.Reader = bufio.NewReader(f)
+	if head, _ := in.(*bufio.Reader).Peek(len(armor.Header)); string(head) == armor.Header {
+		in = armor.NewReader(in)
+	}
+	r, err := age.Decrypt(in, identities...)
+	if err != nil {
+		log.Printf("Could not decrypt %s", c.file)
+		return nil, err
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if err := yaml.NewDecoder(bytes.NewReader(plain)).Decode(&data); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s is not a yaml map: %v", c.file, err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%s holds no credentials", c.file)
+	}
+	// the file does not expire
+	return &VaultRespone{Token: data}, nil
+}
@@ -0,0 +1,110 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// DefaultGitlabMount is the mount of the vault gitlab secrets engine
+const DefaultGitlabMount = "gitlab"
+
+// GitlabToken requests a short lived gitlab token from a role of the vault
+// gitlab secrets engine, instead of reading a long lived one from kv. The
+// lease of the token is revoked by Revoke at the end of the run.
+type GitlabToken struct {
+	vault *Lifecycle
+	mount string
+	role  string
+
+	mu sync.Mutex
+	// leaseId is the lease of the last token, empty once revoked
+	leaseId string
+}
+
+// NewGitlabToken reads tokens of role with the token of the lifecycle, an
+// empty mount uses DefaultGitlabMount
+func NewGitlabToken(lc *Lifecycle, mount, role string) *GitlabToken {
+	if mount == "" {
+		mount = DefaultGitlabMount
+	}
+	return &GitlabToken{
+		vault: lc,
+		mount: mount,
+		role:  role,
+	}
+}
+
+// RetrieveCreds returns a new gitlab token under the "token" key, like the
+// kv secret does, with the expiry of its lease
+func (g *GitlabToken) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	client := g.vault.Client()
+	if client == nil {
+		return nil, errors.New("vault lifecycle is not started")
+	}
+
+	path := "/" + strings.Trim(g.mount, "/") + "/token/" + g.role
+	resp, err := client.Read(ctx, path)
+	if err != nil {
+		log.Printf("Could not request a gitlab token from %s", path)
+		return nil, err
+	}
+	token, _ := resp.Data["token"].(string)
+	if token == "" {
+		return nil, fmt.Errorf("%s returned no token", path)
+	}
+
+	g.mu.Lock()
+	previous := g.leaseId
+	g.leaseId = resp.LeaseID
+	g.mu.Unlock()
+	if previous != "" {
+		// only the last token is in use
+		g.revokeLease(ctx, client, previous)
+	}
+
+	var expire time.Time
+	if resp.LeaseDuration > 0 {
+		expire = time.Now().Add(time.Duration(resp.LeaseDuration) * time.Second)
+	}
+	return &VaultRespone{
+		Token:      map[string]interface{}{"token": token},
+		ExpireTime: formatExpireTime(expire),
+	}, nil
+}
+
+// Revoke revokes the lease of the last token, gitlab deletes the token with it
+func (g *GitlabToken) Revoke(ctx context.Context) error {
+	g.mu.Lock()
+	leaseId := g.leaseId
+	g.leaseId = ""
+	g.mu.Unlock()
+	if leaseId == "" {
+		return nil
+	}
+
+	client := g.vault.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+	if err := g.revokeLease(ctx, client, leaseId); err != nil {
+		return err
+	}
+	log.Println("Gitlab token revoked")
+	return nil
+}
+
+func (g *GitlabToken) revokeLease(ctx context.Context, client *vault.Client, leaseId string) error {
+	_, err := client.System.LeasesRevokeLease(ctx, schema.LeasesRevokeLeaseRequest{LeaseId: leaseId})
+	if err != nil {
+		log.Printf("Could not revoke the gitlab token lease %s: %v", leaseId, err)
+	}
+	return err
+}
@@ -0,0 +1,117 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// DefaultKvMount is the mount of the kv engine holding the gitlab credentials
+const DefaultKvMount = "secret"
+
+// ErrSecretNotFound is returned when a kv secret does not exist
+var ErrSecretNotFound = errors.New("secret not found")
+
+// KvSecret locates a kv secret
+type KvSecret struct {
+	Mount string
+	Path  string
+	// KvVersion is the kv engine version, 1 or 2. Zero detects it from the
+	// mount options on the first read.
+	KvVersion int
+	// Version pins a kv v2 secret version, zero reads the latest one
+	Version int
+}
+
+// detectKvVersion reads the mount options through sys/internal/ui/mounts,
+// which any token allowed on the mount can call
+func (s *KvSecret) detectKvVersion(ctx context.Context, client *vault.Client) int {
+	resp, err := client.Read(ctx, "/sys/internal/ui/mounts/"+strings.Trim(s.mount(), "/"))
+	if err != nil {
+		log.Printf("Could not detect the kv version of %s, assuming v2: %v", s.mount(), err)
+		return 2
+	}
+	options, _ := resp.Data["options"].(map[string]interface{})
+	if v, _ := options["version"].(string); v == "2" {
+		return 2
+	}
+	return 1
+}
+
+func (s *KvSecret) mount() string {
+	if s.Mount == "" {
+		return DefaultKvMount
+	}
+	return s.Mount
+}
+
+// Read returns the data of the secret
+func (s *KvSecret) Read(ctx context.Context, client *vault.Client) (map[string]interface{}, error) {
+	mount := s.mount()
+	if s.KvVersion == 0 {
+		s.KvVersion = s.detectKvVersion(ctx, client)
+	}
+
+	switch s.KvVersion {
+	case 1:
+		if s.Version != 0 {
+			return nil, fmt.Errorf("cannot pin version %d of %s: the kv v1 mount %s is not versioned", s.Version, s.Path, mount)
+		}
+		resp, err := client.Secrets.KvV1Read(ctx, s.Path, vault.WithMountPath(mount))
+		if vault.IsErrorStatus(err, http.StatusNotFound) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrSecretNotFound, mount, s.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	case 2:
+		options := []vault.RequestOption{vault.WithMountPath(mount)}
+		if s.Version != 0 {
+			options = append(options, vault.WithQueryParameters(url.Values{
+				"version": {strconv.Itoa(s.Version)},
+			}))
+		}
+		resp, err := client.Secrets.KvV2Read(ctx, s.Path, options...)
+		if vault.IsErrorStatus(err, http.StatusNotFound) {
+			return nil, fmt.Errorf("%w: %s/%s", ErrSecretNotFound, mount, s.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.Data.Data == nil {
+			// deleted or destroyed versions come back without data
+			return nil, fmt.Errorf("version %d of %s has no data, it may be deleted", s.Version, s.Path)
+		}
+		return resp.Data.Data, nil
+	default:
+		return nil, fmt.Errorf("unsupported kv version %d", s.KvVersion)
+	}
+}
+
+// Write replaces the data of the secret, on kv v2 it creates a new version
+func (s *KvSecret) Write(ctx context.Context, client *vault.Client, data map[string]interface{}) error {
+	mount := s.mount()
+	if s.KvVersion == 0 {
+		s.KvVersion = s.detectKvVersion(ctx, client)
+	}
+
+	var err error
+	switch s.KvVersion {
+	case 1:
+		_, err = client.Secrets.KvV1Write(ctx, s.Path, data, vault.WithMountPath(mount))
+	case 2:
+		_, err = client.Secrets.KvV2Write(ctx, s.Path, schema.KvV2WriteRequest{Data: data}, vault.WithMountPath(mount))
+	default:
+		err = fmt.Errorf("unsupported kv version %d", s.KvVersion)
+	}
+	return err
+}
@@ -0,0 +1,291 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault-client-go"
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+// retryInterval is the wait between two failed renew and login attempts
+const retryInterval = 10 * time.Second
+
+// Lifecycle keeps the token of an Authenticator alive for the whole run. It
+// renews the token in the background, logs in again once the token hits its
+// max TTL or cannot be renewed, revoking the replaced token, and revokes the
+// last one on Stop.
+type Lifecycle struct {
+	creds Authenticator
+	// revoke is false for static tokens, they belong to the caller
+	revoke bool
+
+	mu     sync.RWMutex
+	client *vault.Client
+	auth   *vault.ResponseAuth
+	expire time.Time
+	// capped is set once a renewal returns less than the login TTL
+	capped bool
+	// kvVersions caches the detected kv version of each mount
+	kvVersions map[string]int
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewLifecycle(creds Authenticator) *Lifecycle {
+	_, static := creds.(*Creds)
+	return &Lifecycle{
+		creds:      creds,
+		revoke:     !static,
+		kvVersions: map[string]int{},
+	}
+}
+
+// Start logs in and starts the renewal loop, the loop ends with ctx or Stop
+func (l *Lifecycle) Start(ctx context.Context) error {
+	if err := l.login(ctx); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	go l.run(ctx)
+	return nil
+}
+
+// Client returns the current client, it changes after a new login so callers
+// should not keep it around
+func (l *Lifecycle) Client() *vault.Client {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.client
+}
+
+// ExpireTime returns the expiry of the current token, zero when it does not
+// expire
+func (l *Lifecycle) ExpireTime() time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.expire
+}
+
+func (l *Lifecycle) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	client := l.Client()
+	if client == nil {
+		return nil, errors.New("vault lifecycle is not started")
+	}
+	return readSecret(ctx, client, l.creds.Secret(), l.ExpireTime())
+}
+
+// kvSecret returns a KvSecret with the cached kv version of the mount
+func (l *Lifecycle) kvSecret(mount, path string) *KvSecret {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return &KvSecret{Mount: mount, Path: path, KvVersion: l.kvVersions[mount]}
+}
+
+func (l *Lifecycle) cacheKvVersion(secret *KvSecret) {
+	if secret.KvVersion == 0 {
+		return
+	}
+	l.mu.Lock()
+	l.kvVersions[secret.Mount] = secret.KvVersion
+	l.mu.Unlock()
+}
+
+// ReadSecret reads any kv secret with the current token
+func (l *Lifecycle) ReadSecret(ctx context.Context, mount, path string) (map[string]interface{}, error) {
+	client := l.Client()
+	if client == nil {
+		return nil, errors.New("vault lifecycle is not started")
+	}
+
+	secret := l.kvSecret(mount, path)
+	data, err := secret.Read(ctx, client)
+	l.cacheKvVersion(secret)
+	return data, err
+}
+
+// WriteSecret replaces the data of any kv secret with the current token
+func (l *Lifecycle) WriteSecret(ctx context.Context, mount, path string, data map[string]interface{}) error {
+	client := l.Client()
+	if client == nil {
+		return errors.New("vault lifecycle is not started")
+	}
+
+	secret := l.kvSecret(mount, path)
+	err := secret.Write(ctx, client, data)
+	l.cacheKvVersion(secret)
+	return err
+}
+
+// SignSshKey has the ssh secrets engine on mount sign publicKey with role,
+// it returns the certificate
+func (l *Lifecycle) SignSshKey(ctx context.Context, mount, role, publicKey string) (string, error) {
+	client := l.Client()
+	if client == nil {
+		return "", errors.New("vault lifecycle is not started")
+	}
+
+	path := "/" + strings.Trim(mount, "/") + "/sign/" + role
+	resp, err := client.Write(ctx, path, map[string]interface{}{
+		"public_key": publicKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed, _ := resp.Data["signed_key"].(string)
+	if signed == "" {
+		return "", fmt.Errorf("%s returned no signed key", path)
+	}
+	return strings.TrimSpace(signed), nil
+}
+
+// Stop ends the renewal loop and revokes the token
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	if l.cancel != nil {
+		l.cancel()
+		<-l.done
+	}
+
+	client := l.Client()
+	if client == nil || !l.revoke {
+		return nil
+	}
+	if _, err := l.tokenClient(client).Auth.TokenRevokeSelf(ctx); err != nil {
+		log.Printf("Could not revoke the vault token: %v", err)
+		return err
+	}
+	log.Println("Vault token revoked")
+	return nil
+}
+
+// tokenClient returns a copy of the client in the auth namespace, where the
+// token lives, for the token endpoints
+func (l *Lifecycle) tokenClient(client *vault.Client) *vault.Client {
+	c := client.Clone()
+	if err := setNamespace(c, l.creds.Namespaces().Auth); err != nil {
+		log.Printf("Could not set the auth namespace: %v", err)
+	}
+	return c
+}
+
+func (l *Lifecycle) login(ctx context.Context) error {
+	client, auth, err := l.creds.Login(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	replaced := l.client
+	l.client = client
+	l.auth = auth
+	l.expire = leaseExpiry(auth)
+	l.capped = false
+	l.mu.Unlock()
+
+	// callers take the client for each call, the replaced token is no longer
+	// handed out. It may already be expired when the renewal failed.
+	if replaced != nil && l.revoke {
+		if _, err := l.tokenClient(replaced).Auth.TokenRevokeSelf(ctx); err != nil {
+			log.Printf("Could not revoke the replaced vault token: %v", err)
+		}
+	}
+	return nil
+}
+
+func (l *Lifecycle) renew(ctx context.Context) error {
+	l.mu.RLock()
+	client, auth := l.client, l.auth
+	l.mu.RUnlock()
+
+	resp, err := l.tokenClient(client).Auth.TokenRenewSelf(ctx, schema.TokenRenewSelfRequest{
+		Increment: strconv.Itoa(auth.LeaseDuration),
+	})
+	if err != nil {
+		return err
+	}
+	if resp == nil || resp.Auth == nil {
+		return errors.New("token renewal returned no auth info")
+	}
+
+	l.mu.Lock()
+	l.expire = leaseExpiry(resp.Auth)
+	l.capped = resp.Auth.LeaseDuration < auth.LeaseDuration
+	l.mu.Unlock()
+	return nil
+}
+
+// next returns how long to wait before acting on the token, and whether to
+// log in again rather than renew
+func (l *Lifecycle) next() (time.Duration, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// act once two thirds of the remaining lease have elapsed
+	wait := time.Until(l.expire) * 2 / 3
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, l.capped || !l.auth.Renewable
+}
+
+func (l *Lifecycle) run(ctx context.Context) {
+	defer close(l.done)
+	for {
+		if l.ExpireTime().IsZero() {
+			// non expiring token, nothing to renew
+			<-ctx.Done()
+			return
+		}
+
+		wait, relogin := l.next()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if !relogin {
+			err := l.renew(ctx)
+			if err == nil {
+				log.Printf("Vault token renewed until %s", formatExpireTime(l.ExpireTime()))
+				continue
+			}
+			log.Printf("Could not renew the vault token, logging in again: %v", err)
+		}
+
+		if err := l.login(ctx); err != nil {
+			log.Printf("Could not log in to vault again: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retryInterval):
+			}
+			continue
+		}
+		log.Printf("Logged in to vault again, token valid until %s", formatExpireTime(l.ExpireTime()))
+	}
+}
+
+func leaseExpiry(auth *vault.ResponseAuth) time.Time {
+	if auth == nil || auth.LeaseDuration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(auth.LeaseDuration) * time.Second)
+}
+
+func formatExpireTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
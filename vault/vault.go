@@ -2,7 +2,14 @@ package vault
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/vault-client-go"
@@ -11,24 +18,62 @@ import (
 
 type Creds struct {
 	vault_addr  string
-	vault_path  string
+	secret      KvSecret
+	namespaces  Namespaces
 	vault_token string
 }
 type CredsApprole struct {
 	vault_addr       string
-	vault_path       string
+	secret           KvSecret
+	namespaces       Namespaces
 	approle_roleid   string
 	approle_secretid string
+	// approle_wrapping_token wraps the secret_id, it is unwrapped on the
+	// first login
+	approle_wrapping_token string
 }
+
+// DefaultServiceAccountTokenPath is where kubernetes projects the pod
+// service account token
+const DefaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+type CredsKubernetes struct {
+	vault_addr string
+	secret     KvSecret
+	namespaces Namespaces
+	k8s_mount  string
+	k8s_role   string
+	jwt_path   string
+}
+type CredsJwt struct {
+	vault_addr string
+	secret     KvSecret
+	namespaces Namespaces
+	jwt_mount  string
+	jwt_role   string
+	jwt_env    string
+	jwt_path   string
+}
+
+// Namespaces are the vault enterprise namespaces of the login and of the
+// secret reads, the auth mount and the kv mount can live in different ones.
+// Empty means the root namespace.
+type Namespaces struct {
+	Auth   string
+	Secret string
+}
+
 type VaultRespone struct {
-	Token      map[string]interface{}
+	Token map[string]interface{}
+	// ExpireTime is the RFC 3339 expiry of the vault token used for the
+	// read, empty when the token does not expire
 	ExpireTime string
 }
 
 func NewCreds(addr, path, token string) *Creds {
 	return &Creds{
 		vault_addr:  addr,
-		vault_path:  path,
+		secret:      KvSecret{Mount: DefaultKvMount, Path: path},
 		vault_token: token,
 	}
 }
@@ -36,40 +81,220 @@ func NewCreds(addr, path, token string) *Creds {
 func NewCredsApprole(addr, path, roleid, secretid string) *CredsApprole {
 	return &CredsApprole{
 		vault_addr:       addr,
-		vault_path:       path,
+		secret:           KvSecret{Mount: DefaultKvMount, Path: path},
 		approle_roleid:   roleid,
 		approle_secretid: secretid,
 	}
 }
 
+// NewCredsApproleWrapped takes a response-wrapping token around the secret_id
+// instead of the secret_id itself
+func NewCredsApproleWrapped(addr, path, roleid, wrappingToken string) *CredsApprole {
+	return &CredsApprole{
+		vault_addr:             addr,
+		secret:                 KvSecret{Mount: DefaultKvMount, Path: path},
+		approle_roleid:         roleid,
+		approle_wrapping_token: wrappingToken,
+	}
+}
+
+func NewCredsKubernetes(addr, path, mount, role, jwtPath string) *CredsKubernetes {
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	if jwtPath == "" {
+		jwtPath = DefaultServiceAccountTokenPath
+	}
+	return &CredsKubernetes{
+		vault_addr: addr,
+		secret:     KvSecret{Mount: DefaultKvMount, Path: path},
+		k8s_mount:  mount,
+		k8s_role:   role,
+		jwt_path:   jwtPath,
+	}
+}
+
+// NewCredsJwt logs in with a JWT such as a GitLab CI id_token, read from the
+// jwtEnv environment variable or, when it is empty, from jwtPath
+func NewCredsJwt(addr, path, mount, role, jwtEnv, jwtPath string) *CredsJwt {
+	if mount == "" {
+		mount = "jwt"
+	}
+	return &CredsJwt{
+		vault_addr: addr,
+		secret:     KvSecret{Mount: DefaultKvMount, Path: path},
+		jwt_mount:  mount,
+		jwt_role:   role,
+		jwt_env:    jwtEnv,
+		jwt_path:   jwtPath,
+	}
+}
+
 type GetCreds interface {
 	RetrieveCreds(context.Context) (*VaultRespone, error)
 }
 
-func (c *Creds) InitVault(ctx context.Context) (vault.Client, error) {
+// Authenticator is a GetCreds that can log in again on its own, it is what a
+// Lifecycle needs to keep a token alive
+type Authenticator interface {
+	GetCreds
+	Login(context.Context) (*vault.Client, *vault.ResponseAuth, error)
+	// Secret locates the gitlab credentials, set its mount and versions
+	// before the first read
+	Secret() *KvSecret
+	// Namespaces are set before the first login
+	Namespaces() *Namespaces
+}
+
+// newClient connects to the configured address with the TLS settings of the
+// VAULT_* environment, the token, namespace and address variables are left
+// out. The client starts in the auth namespace.
+func newClient(addr string, ns Namespaces) (*vault.Client, error) {
 	client, err := vault.New(
-		vault.WithAddress(c.vault_addr),
+		vault.WithAddress(addr),
 		vault.WithRequestTimeout(30*time.Second),
+		vault.WithTLS(tlsFromEnv()),
 	)
+	if err != nil {
+		return nil, err
+	}
+	if err := setNamespace(client, ns.Auth); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// tlsFromEnv reads the CA and client certificates of the vault cli
+// environment, a kubernetes pod usually mounts the cluster CA through
+// VAULT_CACERT
+func tlsFromEnv() vault.TLSConfiguration {
+	skipVerify, _ := strconv.ParseBool(os.Getenv("VAULT_SKIP_VERIFY"))
+	return vault.TLSConfiguration{
+		ServerCertificate: vault.ServerCertificateEntry{
+			FromFile:      os.Getenv("VAULT_CACERT"),
+			FromDirectory: os.Getenv("VAULT_CAPATH"),
+		},
+		ClientCertificate:    vault.ClientCertificateEntry{FromFile: os.Getenv("VAULT_CLIENT_CERT")},
+		ClientCertificateKey: vault.ClientCertificateKeyEntry{FromFile: os.Getenv("VAULT_CLIENT_KEY")},
+		ServerName:           os.Getenv("VAULT_TLS_SERVER_NAME"),
+		InsecureSkipVerify:   skipVerify,
+	}
+}
+
+// setNamespace replaces the namespace of all the next requests of the client
+func setNamespace(client *vault.Client, namespace string) error {
+	if namespace == "" {
+		client.ClearNamespace()
+		return nil
+	}
+	return client.SetNamespace(namespace)
+}
+
+// loginClient sets the token from a login response on the client and moves
+// it to the secret namespace
+func loginClient(client *vault.Client, method string, vaultoken *vault.Response[map[string]interface{}], ns Namespaces) (*vault.Client, *vault.ResponseAuth, error) {
+	if vaultoken == nil || vaultoken.Auth == nil {
+		log.Println("Login success but no authentication infos received")
+		return nil, nil, fmt.Errorf("%s login returned no auth info", method)
+	}
+	if err := client.SetToken(vaultoken.Auth.ClientToken); err != nil {
+		log.Println("Could not connect to vault")
+		return nil, nil, err
+	}
+	if err := setNamespace(client, ns.Secret); err != nil {
+		return nil, nil, err
+	}
+	return client, vaultoken.Auth, nil
+}
+
+// Login sets the static token and looks it up to learn its TTL
+func (c *Creds) Login(ctx context.Context) (*vault.Client, *vault.ResponseAuth, error) {
+	client, err := newClient(c.vault_addr, c.namespaces)
 	if err != nil {
 		log.Print("could not initialize vault")
-		return vault.Client{}, err
+		return nil, nil, err
 	}
 	if err := client.SetToken(c.vault_token); err != nil {
 		log.Print("Could not connect to vault")
+		return nil, nil, err
+	}
+
+	auth := &vault.ResponseAuth{ClientToken: c.vault_token}
+	self, err := client.Auth.TokenLookUpSelf(ctx)
+	if err := setNamespace(client, c.namespaces.Secret); err != nil {
+		return nil, nil, err
+	}
+	if err != nil {
+		// the token may lack lookup-self, treat it as non expiring
+		log.Printf("Could not look up the vault token: %v", err)
+		return client, auth, nil
+	}
+	if ttl, ok := self.Data["ttl"].(json.Number); ok {
+		if v, err := ttl.Int64(); err == nil {
+			auth.LeaseDuration = int(v)
+		}
+	}
+	auth.Renewable, _ = self.Data["renewable"].(bool)
+	auth.Accessor, _ = self.Data["accessor"].(string)
+	return client, auth, nil
+}
+
+func (c *Creds) InitVault(ctx context.Context) (vault.Client, error) {
+	client, _, err := c.Login(ctx)
+	if err != nil {
 		return vault.Client{}, err
 	}
 	return *client.Clone(), nil
 }
 
-func (c *CredsApprole) InitVault(ctx context.Context) (vault.Client, error) {
-	client, err := vault.New(
-		vault.WithAddress(c.vault_addr),
-		vault.WithRequestTimeout(30*time.Second),
-	)
+// secretIdCreationPath matches the paths a wrapped secret_id can come from
+var secretIdCreationPath = regexp.MustCompile(`^auth/approle/role/[^/]+/(custom-)?secret-id$`)
+
+// unwrapSecretId checks where the wrapping token comes from and unwraps the
+// secret_id. A token that cannot be looked up was either already unwrapped,
+// maybe by someone who intercepted it, or has expired.
+func (c *CredsApprole) unwrapSecretId(ctx context.Context, client *vault.Client) error {
+	lookup, err := client.Write(ctx, "/sys/wrapping/lookup", map[string]interface{}{
+		"token": c.approle_wrapping_token,
+	})
+	if err != nil {
+		log.Printf("SECURITY: the secret_id wrapping token is invalid, expired or was already unwrapped: %v", err)
+		return fmt.Errorf("secret_id wrapping token is invalid, expired or was already unwrapped: %w", err)
+	}
+
+	creationPath, _ := lookup.Data["creation_path"].(string)
+	if !secretIdCreationPath.MatchString(creationPath) {
+		log.Printf("SECURITY: the secret_id wrapping token was created by %q, not by an approle secret-id endpoint", creationPath)
+		return fmt.Errorf("secret_id wrapping token has unexpected creation path %q", creationPath)
+	}
+
+	unwrapped, err := client.System.Unwrap(ctx, schema.UnwrapRequest{}, vault.WithToken(c.approle_wrapping_token))
+	if err != nil {
+		log.Printf("SECURITY: could not unwrap the secret_id, it may have been unwrapped concurrently: %v", err)
+		return fmt.Errorf("could not unwrap the secret_id: %w", err)
+	}
+	secretId, _ := unwrapped.Data["secret_id"].(string)
+	if secretId == "" {
+		return errors.New("unwrapped response holds no secret_id")
+	}
+
+	// a wrapping token is single use, keep the secret_id for the next logins
+	c.approle_secretid = secretId
+	c.approle_wrapping_token = ""
+	return nil
+}
+
+func (c *CredsApprole) Login(ctx context.Context) (*vault.Client, *vault.ResponseAuth, error) {
+	client, err := newClient(c.vault_addr, c.namespaces)
 	if err != nil {
 		log.Println("could not initialize vault")
-		return vault.Client{}, err
+		return nil, nil, err
+	}
+
+	if c.approle_wrapping_token != "" {
+		if err := c.unwrapSecretId(ctx, client); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	vaultoken, err := client.Auth.AppRoleLogin(ctx, schema.AppRoleLoginRequest{
@@ -79,58 +304,155 @@ func (c *CredsApprole) InitVault(ctx context.Context) (vault.Client, error) {
 		vault.WithMountPath("approle"))
 	if err != nil {
 		log.Printf("Could not retrieve the token with approle because of the error %v", err)
-		return vault.Client{}, err
+		return nil, nil, err
 	}
 
-	if vaultoken == nil || vaultoken.Auth == nil {
-		log.Println("Login success but no authentication infos received")
+	return loginClient(client, "approle", vaultoken, c.namespaces)
+}
+
+func (c *CredsApprole) InitVault(ctx context.Context) (vault.Client, error) {
+	client, _, err := c.Login(ctx)
+	if err != nil {
 		return vault.Client{}, err
 	}
-	if err := client.SetToken(vaultoken.Auth.ClientToken); err != nil {
-		log.Println("Could not connect to vault")
-		return vault.Client{}, err
+	return *client.Clone(), nil
+}
+
+func (c *CredsKubernetes) Login(ctx context.Context) (*vault.Client, *vault.ResponseAuth, error) {
+	// the projected token is rotated by the kubelet, read it on every login
+	jwt, err := os.ReadFile(c.jwt_path)
+	if err != nil {
+		log.Printf("Could not read the service account token %s", c.jwt_path)
+		return nil, nil, err
+	}
+
+	client, err := newClient(c.vault_addr, c.namespaces)
+	if err != nil {
+		log.Println("could not initialize vault")
+		return nil, nil, err
 	}
 
-	// Print token details
+	vaultoken, err := client.Auth.KubernetesLogin(ctx, schema.KubernetesLoginRequest{
+		Jwt:  strings.TrimSpace(string(jwt)),
+		Role: c.k8s_role,
+	},
+		vault.WithMountPath(c.k8s_mount))
+	if err != nil {
+		log.Printf("Could not retrieve the token with kubernetes because of the error %v", err)
+		return nil, nil, err
+	}
+
+	return loginClient(client, "kubernetes", vaultoken, c.namespaces)
+}
 
+func (c *CredsKubernetes) InitVault(ctx context.Context) (vault.Client, error) {
+	client, _, err := c.Login(ctx)
+	if err != nil {
+		return vault.Client{}, err
+	}
 	return *client.Clone(), nil
 }
 
-func (c *Creds) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
-	client, err := c.InitVault(ctx)
+func (c *CredsJwt) readJwt() (string, error) {
+	if c.jwt_env != "" {
+		if jwt := os.Getenv(c.jwt_env); jwt != "" {
+			return strings.TrimSpace(jwt), nil
+		}
+	}
+	if c.jwt_path == "" {
+		return "", fmt.Errorf("no JWT found in %s and no JWT file configured", c.jwt_env)
+	}
+	jwt, err := os.ReadFile(c.jwt_path)
 	if err != nil {
-		log.Println("Could not set the vault")
-		return nil, err
+		return "", err
 	}
+	return strings.TrimSpace(string(jwt)), nil
+}
 
-	resp, err := client.Secrets.KvV2Read(ctx, c.vault_path, vault.WithMountPath("secret"))
+func (c *CredsJwt) Login(ctx context.Context) (*vault.Client, *vault.ResponseAuth, error) {
+	jwt, err := c.readJwt()
 	if err != nil {
-		log.Printf("Could not retrieve the secret %s", c.vault_path)
-		return nil, err
+		log.Printf("Could not read the JWT because of the error %v", err)
+		return nil, nil, err
 	}
-	return &VaultRespone{
-		Token:      resp.Data.Data,
-		ExpireTime: "",
-	}, nil
+
+	client, err := newClient(c.vault_addr, c.namespaces)
+	if err != nil {
+		log.Println("could not initialize vault")
+		return nil, nil, err
+	}
+
+	vaultoken, err := client.Auth.JwtLogin(ctx, schema.JwtLoginRequest{
+		Jwt:  jwt,
+		Role: c.jwt_role,
+	},
+		vault.WithMountPath(c.jwt_mount))
+	if err != nil {
+		log.Printf("Could not retrieve the token with jwt because of the error %v", err)
+		return nil, nil, err
+	}
+
+	return loginClient(client, "jwt", vaultoken, c.namespaces)
 }
 
-func (c *CredsApprole) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
-	client, err := c.InitVault(ctx)
+func (c *CredsJwt) InitVault(ctx context.Context) (vault.Client, error) {
+	client, _, err := c.Login(ctx)
 	if err != nil {
-		log.Println("Could not set the vault")
-		return nil, err
+		return vault.Client{}, err
 	}
-	resp, err := client.Secrets.KvV2Read(ctx, c.vault_path, vault.WithMountPath("secret"))
+	return *client.Clone(), nil
+}
+
+func (c *Creds) Secret() *KvSecret           { return &c.secret }
+func (c *CredsApprole) Secret() *KvSecret    { return &c.secret }
+func (c *CredsKubernetes) Secret() *KvSecret { return &c.secret }
+func (c *CredsJwt) Secret() *KvSecret        { return &c.secret }
+
+func (c *Creds) Namespaces() *Namespaces           { return &c.namespaces }
+func (c *CredsApprole) Namespaces() *Namespaces    { return &c.namespaces }
+func (c *CredsKubernetes) Namespaces() *Namespaces { return &c.namespaces }
+func (c *CredsJwt) Namespaces() *Namespaces        { return &c.namespaces }
+
+// readSecret reads the kv secret holding the gitlab credentials
+func readSecret(ctx context.Context, client *vault.Client, secret *KvSecret, expire time.Time) (*VaultRespone, error) {
+	data, err := secret.Read(ctx, client)
 	if err != nil {
-		log.Printf("Could not retrieve the secret %s", c.vault_path)
+		log.Printf("Could not retrieve the secret %s", secret.Path)
 		return nil, err
 	}
 	return &VaultRespone{
-		Token:      resp.Data.Data,
-		ExpireTime: "",
+		Token:      data,
+		ExpireTime: formatExpireTime(expire),
 	}, nil
 }
 
+// retrieveCreds logs in once and reads the secret, the token is left to
+// expire on its own. Use a Lifecycle to keep it alive and revoke it.
+func retrieveCreds(ctx context.Context, a Authenticator) (*VaultRespone, error) {
+	client, auth, err := a.Login(ctx)
+	if err != nil {
+		log.Println("Could not set the vault")
+		return nil, err
+	}
+	return readSecret(ctx, client, a.Secret(), leaseExpiry(auth))
+}
+
+func (c *Creds) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	return retrieveCreds(ctx, c)
+}
+
+func (c *CredsApprole) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	return retrieveCreds(ctx, c)
+}
+
+func (c *CredsKubernetes) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	return retrieveCreds(ctx, c)
+}
+
+func (c *CredsJwt) RetrieveCreds(ctx context.Context) (*VaultRespone, error) {
+	return retrieveCreds(ctx, c)
+}
+
 func GetSecret(gt GetCreds, ctx context.Context) (*VaultRespone, error) {
 	resp, err := gt.RetrieveCreds(ctx)
 	if err != nil {
@@ -1,10 +1,32 @@
 package vault
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/go-jose/go-jose/v4"
+	josejwt "github.com/go-jose/go-jose/v4/jwt"
+	credJWT "github.com/hashicorp/vault-plugin-auth-jwt"
+	credKube "github.com/hashicorp/vault-plugin-auth-kubernetes"
+	logicalKv "github.com/hashicorp/vault-plugin-secrets-kv"
 	"github.com/hashicorp/vault/api"
+	credAppRole "github.com/hashicorp/vault/builtin/credential/approle"
+	vaulthttp "github.com/hashicorp/vault/http"
+	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hashicorp/vault/vault"
 )
 
@@ -12,18 +34,86 @@ const (
 	testToken = "mor"
 )
 
-func TestRetrieveCreds(t *testing.T) {
+// startTestCluster starts a single core cluster serving the http API with a
+// kv v2 engine mounted on secret/
+func startTestCluster(t *testing.T) (*vault.TestCluster, *api.Client) {
+	t.Helper()
 	cluster := vault.NewTestCluster(t, &vault.CoreConfig{
 		DevToken: testToken,
-	}, &vault.TestClusterOptions{})
+		EnableUI: false,
+		LogicalBackends: map[string]logical.Factory{
+			"kv": logicalKv.Factory,
+		},
+		CredentialBackends: map[string]logical.Factory{
+			"approle":    credAppRole.Factory,
+			"kubernetes": credKube.Factory,
+			"jwt":        credJWT.Factory,
+		},
+	}, &vault.TestClusterOptions{
+		NumCores:    1,
+		HandlerFunc: vaulthttp.Handler,
+	})
 	cluster.Start()
-	defer cluster.Cleanup()
+	t.Cleanup(cluster.Cleanup)
 
 	core := cluster.Cores[0].Core
 	vault.TestWaitActive(t, core)
 	client := cluster.Cores[0].Client
+
+	// NewTestCluster ignores DevToken, create it from the root token
+	client.SetToken(cluster.RootToken)
+	_, err := client.Auth().Token().Create(&api.TokenCreateRequest{
+		ID:       testToken,
+		Policies: []string{"root"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create test token: %v", err)
+	}
 	client.SetToken(testToken)
 
+	// the vault-client-go clients built by the package trust the cluster CA
+	t.Setenv("VAULT_CACERT", cluster.CACertPEMFile)
+
+	// the cluster mounts secret/ as kv v1
+	err = client.Sys().TuneMount("secret", api.MountConfigInput{
+		Options: map[string]string{"version": "2"},
+	})
+	if err != nil {
+		t.Fatalf("failed to upgrade kv: %v", err)
+	}
+	// the kv v2 upgrade runs in the background after the tune, writes only
+	// return a version once it is done
+	waitFor(t, 10*time.Second, "the kv v2 upgrade", func() bool {
+		resp, err := client.Logical().Write("secret/data/kv-upgrade", map[string]interface{}{
+			"data": map[string]interface{}{},
+		})
+		return err == nil && resp != nil && resp.Data["version"] != nil
+	})
+
+	// policy given to the tokens issued by the auth methods
+	err = client.Sys().PutPolicy("gitlab", `path "secret/data/test" { capabilities = ["read"] }`)
+	if err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+
+	return cluster, client
+}
+
+// waitFor polls cond until it holds, it fails the test after timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRetrieveCreds(t *testing.T) {
+	_, client := startTestCluster(t)
+
 	// Write a test secret to the vault
 	_, err := client.Logical().Write("secret/data/test", map[string]interface{}{
 		"data": map[string]interface{}{
@@ -45,20 +135,33 @@ func TestRetrieveCreds(t *testing.T) {
 	}
 }
 
-func TestRetrieveCredsApprole(t *testing.T) {
-	cluster := vault.NewTestCluster(t, &vault.CoreConfig{
-		DevToken: testToken,
-		EnableUI: false,
-	}, &vault.TestClusterOptions{
-		NumCores: 1,
-	})
-	cluster.Start()
-	defer cluster.Cleanup()
+func TestNewClientEnvironment(t *testing.T) {
+	// the vault cli variables of the shell must not change the login
+	var token, namespace string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, namespace = r.Header.Get("X-Vault-Token"), r.Header.Get("X-Vault-Namespace")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{}}`))
+	}))
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", "http://127.0.0.1:1")
+	t.Setenv("VAULT_TOKEN", "shell-token")
+	t.Setenv("VAULT_NAMESPACE", "shell-ns")
 
-	core := cluster.Cores[0].Core
-	vault.TestWaitActive(t, core)
-	client := cluster.Cores[0].Client
-	client.SetToken(testToken)
+	client, err := newClient(srv.URL, Namespaces{})
+	if err != nil {
+		t.Fatalf("newClient: %v", err)
+	}
+	if _, err := client.Read(context.Background(), "secret/test"); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if token != "" || namespace != "" {
+		t.Errorf("Expected no token nor namespace from the environment, got %q and %q", token, namespace)
+	}
+}
+
+func TestRetrieveCredsApprole(t *testing.T) {
+	_, client := startTestCluster(t)
 
 	// Enable AppRole auth method
 	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
@@ -75,7 +178,7 @@ func TestRetrieveCredsApprole(t *testing.T) {
 
 	// Create an AppRole role
 	_, err = client.Logical().Write("auth/approle/role/test-role", map[string]interface{}{
-		"token_policies": []string{"default"},
+		"token_policies": []string{"default", "gitlab"},
 		"token_ttl":      "1h",
 		"token_max_ttl":  "2h",
 	})
@@ -119,3 +222,785 @@ func TestRetrieveCredsApprole(t *testing.T) {
 		t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
 	}
 }
+
+func TestRetrieveCredsKubernetes(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	// Stand-in for the kubernetes TokenReview API
+	k8s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/authentication.k8s.io/v1/tokenreviews" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "TokenReview",
+			"apiVersion": "authentication.k8s.io/v1",
+			"status": map[string]interface{}{
+				"authenticated": true,
+				"user": map[string]interface{}{
+					"username": "system:serviceaccount:default:gitlab-vault",
+					"uid":      "d3a2a3c1-0000-4000-8000-000000000001",
+				},
+			},
+		})
+	}))
+	defer k8s.Close()
+
+	err := client.Sys().EnableAuthWithOptions("k8s", &api.EnableAuthOptions{
+		Type: "kubernetes",
+	})
+	if err != nil {
+		t.Fatalf("failed to enable kubernetes auth: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/k8s/config", map[string]interface{}{
+		"kubernetes_host":        k8s.URL,
+		"disable_local_ca_jwt":   true,
+		"disable_iss_validation": true,
+	})
+	if err != nil {
+		t.Fatalf("failed to configure kubernetes auth: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/k8s/role/gitlab-vault", map[string]interface{}{
+		"bound_service_account_names":      []string{"gitlab-vault"},
+		"bound_service_account_namespaces": []string{"default"},
+		"token_policies":                   []string{"default", "gitlab"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create kubernetes role: %v", err)
+	}
+
+	_, err = client.Logical().Write("secret/data/test", map[string]interface{}{
+		"data": map[string]interface{}{
+			"key": "value",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	jwtPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(jwtPath, []byte(testServiceAccountJWT(t)), 0o600); err != nil {
+		t.Fatalf("failed to write service account token: %v", err)
+	}
+
+	credsKube := NewCredsKubernetes(client.Address(), "test", "k8s", "gitlab-vault", jwtPath)
+	resp, err := credsKube.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve creds with kubernetes: %v", err)
+	}
+	if resp == nil || resp.Token["key"] != "value" {
+		t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+	}
+}
+
+// testServiceAccountJWT signs a legacy service account token, the plugin only
+// checks its claims since no pem_keys are configured
+func testServiceAccountJWT(t *testing.T) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, nil)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	token, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"iss":                                    "kubernetes/serviceaccount",
+		"sub":                                    "system:serviceaccount:default:gitlab-vault",
+		"kubernetes.io/serviceaccount/namespace": "default",
+		"kubernetes.io/serviceaccount/service-account.name": "gitlab-vault",
+		"kubernetes.io/serviceaccount/service-account.uid":  "d3a2a3c1-0000-4000-8000-000000000001",
+	}).Serialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestRetrieveCredsJwt(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	jwk := jose.JSONWebKey{Key: key.Public(), KeyID: "ci", Algorithm: string(jose.RS256), Use: "sig"}
+
+	// Stand-in for the GitLab JWKS endpoint
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{jwk}})
+	}))
+	defer jwks.Close()
+
+	err = client.Sys().EnableAuthWithOptions("jwt", &api.EnableAuthOptions{
+		Type: "jwt",
+	})
+	if err != nil {
+		t.Fatalf("failed to enable jwt auth: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/jwt/config", map[string]interface{}{
+		"jwks_url":     jwks.URL,
+		"bound_issuer": "https://gitlab.example.com",
+	})
+	if err != nil {
+		t.Fatalf("failed to configure jwt auth: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/jwt/role/gitlab-vault", map[string]interface{}{
+		"role_type":       "jwt",
+		"user_claim":      "sub",
+		"bound_audiences": []string{"https://vault.example.com"},
+		"bound_claims":    map[string]interface{}{"project_id": "42"},
+		"token_policies":  []string{"default", "gitlab"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create jwt role: %v", err)
+	}
+
+	_, err = client.Logical().Write("secret/data/test", map[string]interface{}{
+		"data": map[string]interface{}{
+			"key": "value",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", "ci"))
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	now := time.Now()
+	idToken, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+		"iss":        "https://gitlab.example.com",
+		"sub":        "project_path:mor/app:ref_type:branch:ref:main",
+		"aud":        "https://vault.example.com",
+		"project_id": "42",
+		"iat":        now.Unix(),
+		"nbf":        now.Unix(),
+		"exp":        now.Add(5 * time.Minute).Unix(),
+	}).Serialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("VAULT_ID_TOKEN", idToken)
+		credsJwt := NewCredsJwt(client.Address(), "test", "jwt", "gitlab-vault", "VAULT_ID_TOKEN", "")
+		resp, err := credsJwt.RetrieveCreds(context.Background())
+		if err != nil {
+			t.Fatalf("failed to retrieve creds with jwt: %v", err)
+		}
+		if resp == nil || resp.Token["key"] != "value" {
+			t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		jwtPath := filepath.Join(t.TempDir(), "id_token")
+		if err := os.WriteFile(jwtPath, []byte(idToken+"\n"), 0o600); err != nil {
+			t.Fatalf("failed to write id token: %v", err)
+		}
+		credsJwt := NewCredsJwt(client.Address(), "test", "", "gitlab-vault", "VAULT_ID_TOKEN_UNSET", jwtPath)
+		resp, err := credsJwt.RetrieveCreds(context.Background())
+		if err != nil {
+			t.Fatalf("failed to retrieve creds with jwt: %v", err)
+		}
+		if resp == nil || resp.Token["key"] != "value" {
+			t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+		}
+	})
+
+	t.Run("wrong project", func(t *testing.T) {
+		other, err := josejwt.Signed(signer).Claims(map[string]interface{}{
+			"iss":        "https://gitlab.example.com",
+			"sub":        "project_path:mor/other:ref_type:branch:ref:main",
+			"aud":        "https://vault.example.com",
+			"project_id": "7",
+			"exp":        now.Add(5 * time.Minute).Unix(),
+		}).Serialize()
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		t.Setenv("VAULT_ID_TOKEN", other)
+		credsJwt := NewCredsJwt(client.Address(), "test", "jwt", "gitlab-vault", "VAULT_ID_TOKEN", "")
+		if _, err := credsJwt.RetrieveCreds(context.Background()); err == nil {
+			t.Fatal("expected login with an unbound project_id to fail")
+		}
+	})
+}
+
+func TestLifecycle(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
+		Type: "approle",
+	})
+	if err != nil {
+		t.Fatalf("failed to enable approle auth: %v", err)
+	}
+
+	// short lived tokens so the test sees a renewal and a new login
+	_, err = client.Logical().Write("auth/approle/role/test-role", map[string]interface{}{
+		"token_policies": []string{"default", "gitlab"},
+		"token_ttl":      "3s",
+		"token_max_ttl":  "5s",
+	})
+	if err != nil {
+		t.Fatalf("failed to create approle role: %v", err)
+	}
+
+	roleIDResp, err := client.Logical().Read("auth/approle/role/test-role/role-id")
+	if err != nil {
+		t.Fatalf("failed to get role ID: %v", err)
+	}
+	roleID := roleIDResp.Data["role_id"].(string)
+
+	secretIDResp, err := client.Logical().Write("auth/approle/role/test-role/secret-id", nil)
+	if err != nil {
+		t.Fatalf("failed to generate secret ID: %v", err)
+	}
+	secretID := secretIDResp.Data["secret_id"].(string)
+
+	_, err = client.Logical().Write("secret/data/test", map[string]interface{}{
+		"data": map[string]interface{}{
+			"key": "value",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	lc := NewLifecycle(NewCredsApprole(client.Address(), "test", roleID, secretID))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start lifecycle: %v", err)
+	}
+	firstToken := lc.auth.ClientToken
+
+	resp, err := lc.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve creds: %v", err)
+	}
+	expire, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		t.Fatalf("expected an RFC 3339 expire time, got %q: %v", resp.ExpireTime, err)
+	}
+	if until := time.Until(expire); until <= 0 || until > 4*time.Second {
+		t.Fatalf("expected the token to expire within the role TTL, got %s", until)
+	}
+
+	// the lifecycle logs in again before the max TTL
+	waitFor(t, 10*time.Second, "a new login", func() bool {
+		lc.mu.RLock()
+		defer lc.mu.RUnlock()
+		return lc.auth.ClientToken != firstToken
+	})
+
+	resp, err = lc.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve creds after the max TTL: %v", err)
+	}
+	if resp.Token["key"] != "value" {
+		t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+	}
+	lc.mu.RLock()
+	lastToken := lc.auth.ClientToken
+	lc.mu.RUnlock()
+	if lastToken == firstToken {
+		t.Fatal("expected a new token after the max TTL")
+	}
+
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop lifecycle: %v", err)
+	}
+	if _, err := client.Auth().Token().Lookup(lastToken); err == nil {
+		t.Fatal("expected the token to be revoked on stop")
+	}
+}
+
+func TestRetrieveCredsApproleWrapped(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	err := client.Sys().EnableAuthWithOptions("approle", &api.EnableAuthOptions{
+		Type: "approle",
+	})
+	if err != nil {
+		t.Fatalf("failed to enable approle auth: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/approle/role/test-role", map[string]interface{}{
+		"token_policies": []string{"default", "gitlab"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create approle role: %v", err)
+	}
+
+	roleIDResp, err := client.Logical().Read("auth/approle/role/test-role/role-id")
+	if err != nil {
+		t.Fatalf("failed to get role ID: %v", err)
+	}
+	roleID := roleIDResp.Data["role_id"].(string)
+
+	_, err = client.Logical().Write("secret/data/test", map[string]interface{}{
+		"data": map[string]interface{}{
+			"key": "value",
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	wrapping, err := client.Clone()
+	if err != nil {
+		t.Fatalf("failed to clone client: %v", err)
+	}
+	wrapping.SetToken(testToken)
+	wrapping.SetWrappingLookupFunc(func(operation, path string) string { return "5m" })
+
+	secretIDResp, err := wrapping.Logical().Write("auth/approle/role/test-role/secret-id", nil)
+	if err != nil {
+		t.Fatalf("failed to generate wrapped secret ID: %v", err)
+	}
+	if secretIDResp == nil || secretIDResp.WrapInfo == nil {
+		t.Fatal("expected a wrapped secret ID response")
+	}
+	wrappingToken := secretIDResp.WrapInfo.Token
+
+	creds := NewCredsApproleWrapped(client.Address(), "test", roleID, wrappingToken)
+	resp, err := creds.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve creds with wrapped secret id: %v", err)
+	}
+	if resp == nil || resp.Token["key"] != "value" {
+		t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+	}
+
+	// the unwrapped secret_id is kept for the next logins
+	if _, err := creds.RetrieveCreds(context.Background()); err != nil {
+		t.Fatalf("failed to log in again with the unwrapped secret id: %v", err)
+	}
+
+	t.Run("already unwrapped", func(t *testing.T) {
+		replay := NewCredsApproleWrapped(client.Address(), "test", roleID, wrappingToken)
+		if _, err := replay.RetrieveCreds(context.Background()); err == nil {
+			t.Fatal("expected login with an already unwrapped token to fail")
+		}
+	})
+
+	t.Run("unexpected creation path", func(t *testing.T) {
+		other, err := wrapping.Logical().Write("sys/wrapping/wrap", map[string]interface{}{
+			"secret_id": "forged",
+		})
+		if err != nil {
+			t.Fatalf("failed to wrap data: %v", err)
+		}
+		forged := NewCredsApproleWrapped(client.Address(), "test", roleID, other.WrapInfo.Token)
+		_, err = forged.RetrieveCreds(context.Background())
+		if err == nil || !strings.Contains(err.Error(), "creation path") {
+			t.Fatalf("expected a creation path error, got: %v", err)
+		}
+	})
+}
+
+func TestRetrieveCredsKv(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	err := client.Sys().Mount("kv1", &api.MountInput{Type: "kv"})
+	if err != nil {
+		t.Fatalf("failed to mount kv v1: %v", err)
+	}
+	_, err = client.Logical().Write("kv1/test", map[string]interface{}{
+		"key": "v1",
+	})
+	if err != nil {
+		t.Fatalf("failed to write kv v1 secret: %v", err)
+	}
+
+	for _, value := range []string{"first", "second"} {
+		_, err = client.Logical().Write("secret/data/test", map[string]interface{}{
+			"data": map[string]interface{}{
+				"key": value,
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to write secret: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		secret  KvSecret
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "detect kv v1",
+			secret: KvSecret{Mount: "kv1", Path: "test"},
+			want:   "v1",
+		},
+		{
+			name:   "latest kv v2",
+			secret: KvSecret{Mount: "secret", Path: "test"},
+			want:   "second",
+		},
+		{
+			name:   "pinned kv v2",
+			secret: KvSecret{Mount: "secret", Path: "test", KvVersion: 2, Version: 1},
+			want:   "first",
+		},
+		{
+			name:    "pinned kv v1",
+			secret:  KvSecret{Mount: "kv1", Path: "test", KvVersion: 1, Version: 1},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds := NewCreds(client.Address(), "test", testToken)
+			*creds.Secret() = tt.secret
+			resp, err := creds.RetrieveCreds(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to retrieve creds: %v", err)
+			}
+			if resp.Token["key"] != tt.want {
+				t.Fatalf("expected key to be %q, got: %v", tt.want, resp.Token["key"])
+			}
+		})
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	// namespaces are a vault enterprise feature, a stand-in records the
+	// namespace header of each call
+	var mu sync.Mutex
+	namespaces := map[string]string{}
+	auth := `{"data":{},"auth":{"client_token":"ns-token","accessor":"ns-accessor","lease_duration":60,"renewable":true}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		namespaces[r.URL.Path] = r.Header.Get("X-Vault-Namespace")
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login", "/v1/auth/token/renew-self":
+			w.Write([]byte(auth))
+		case "/v1/auth/token/revoke-self":
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/sys/internal/ui/mounts/secret":
+			w.Write([]byte(`{"data":{"type":"kv","options":{"version":"2"}}}`))
+		case "/v1/secret/data/test":
+			w.Write([]byte(`{"data":{"data":{"key":"value"},"metadata":{"version":1}}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	creds := NewCredsApprole(srv.URL, "test", "role", "secret")
+	ns := creds.Namespaces()
+	ns.Auth = "mor"
+	ns.Secret = "mor/prod"
+
+	lc := NewLifecycle(creds)
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start lifecycle: %v", err)
+	}
+	resp, err := lc.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to retrieve creds: %v", err)
+	}
+	if resp.Token["key"] != "value" {
+		t.Fatalf("expected key to be 'value', got: %v", resp.Token["key"])
+	}
+	if err := lc.renew(context.Background()); err != nil {
+		t.Fatalf("failed to renew: %v", err)
+	}
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop lifecycle: %v", err)
+	}
+
+	want := map[string]string{
+		"/v1/auth/approle/login":            "mor",
+		"/v1/sys/internal/ui/mounts/secret": "mor/prod",
+		"/v1/secret/data/test":              "mor/prod",
+		"/v1/auth/token/renew-self":         "mor",
+		"/v1/auth/token/revoke-self":        "mor",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for path, ns := range want {
+		got, ok := namespaces[path]
+		if !ok {
+			t.Errorf("%s was not called", path)
+			continue
+		}
+		if got != ns {
+			t.Errorf("%s: expected namespace %q, got %q", path, ns, got)
+		}
+	}
+}
+
+func TestRelogin(t *testing.T) {
+	// each login issues a new token, revoke-self records the revoked ones
+	var mu sync.Mutex
+	logins := 0
+	revoked := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			mu.Lock()
+			logins++
+			n := logins
+			mu.Unlock()
+			fmt.Fprintf(w, `{"data":{},"auth":{"client_token":"token-%d","lease_duration":60,"renewable":true}}`, n)
+		case "/v1/auth/token/revoke-self":
+			mu.Lock()
+			revoked = append(revoked, r.Header.Get("X-Vault-Token"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	lc := NewLifecycle(NewCredsApprole(srv.URL, "test", "role", "secret"))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start lifecycle: %v", err)
+	}
+	if err := lc.login(context.Background()); err != nil {
+		t.Fatalf("failed to log in again: %v", err)
+	}
+	if err := lc.Stop(context.Background()); err != nil {
+		t.Fatalf("failed to stop lifecycle: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"token-1", "token-2"}
+	if strings.Join(revoked, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected tokens %v to be revoked, got %v", want, revoked)
+	}
+}
+
+func TestGitlabToken(t *testing.T) {
+	// stand-in for the gitlab secrets engine, each read issues a new lease
+	var mu sync.Mutex
+	issued := 0
+	revoked := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			w.Write([]byte(`{"data":{"ttl":0,"renewable":false,"accessor":"static"}}`))
+		case "/v1/gitlab/token/ci":
+			mu.Lock()
+			issued++
+			n := issued
+			mu.Unlock()
+			fmt.Fprintf(w, `{"lease_id":"gitlab/token/ci/%d","lease_duration":3600,"renewable":false,"data":{"token":"glpat-%d"}}`, n, n)
+		case "/v1/sys/leases/revoke":
+			var body struct {
+				LeaseId string `json:"lease_id"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			revoked = append(revoked, body.LeaseId)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	lc := NewLifecycle(NewCreds(srv.URL, "unused", testToken))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start lifecycle: %v", err)
+	}
+	defer lc.Stop(context.Background())
+
+	gt := NewGitlabToken(lc, "", "ci")
+	resp, err := GetSecret(gt, context.Background())
+	if err != nil {
+		t.Fatalf("failed to get a gitlab token: %v", err)
+	}
+	if resp.Token["token"] != "glpat-1" {
+		t.Fatalf("expected token to be 'glpat-1', got: %v", resp.Token["token"])
+	}
+	expire, err := time.Parse(time.RFC3339, resp.ExpireTime)
+	if err != nil {
+		t.Fatalf("expected an RFC 3339 expire time, got %q: %v", resp.ExpireTime, err)
+	}
+	if until := time.Until(expire); until <= 59*time.Minute || until > time.Hour {
+		t.Fatalf("expected the token to expire with its lease, got %s", until)
+	}
+
+	// a second token replaces the first one
+	resp, err = gt.RetrieveCreds(context.Background())
+	if err != nil {
+		t.Fatalf("failed to get a second gitlab token: %v", err)
+	}
+	if resp.Token["token"] != "glpat-2" {
+		t.Fatalf("expected token to be 'glpat-2', got: %v", resp.Token["token"])
+	}
+
+	if err := gt.Revoke(context.Background()); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if err := gt.Revoke(context.Background()); err != nil {
+		t.Fatalf("expected a second revoke to do nothing, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"gitlab/token/ci/1", "gitlab/token/ci/2"}
+	if strings.Join(revoked, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected leases %v to be revoked, got %v", want, revoked)
+	}
+}
+
+func TestJwtRoles(t *testing.T) {
+	_, client := startTestCluster(t)
+
+	err := client.Sys().EnableAuthWithOptions("jwt", &api.EnableAuthOptions{
+		Type: "jwt",
+	})
+	if err != nil {
+		t.Fatalf("failed to enable jwt auth: %v", err)
+	}
+
+	lc := NewLifecycle(NewCreds(client.Address(), "test", testToken))
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start lifecycle: %v", err)
+	}
+	defer lc.Stop(context.Background())
+	ctx := context.Background()
+
+	roles, err := lc.ListJwtRoles(ctx, "jwt")
+	if err != nil || len(roles) != 0 {
+		t.Fatalf("expected no role, got %v: %v", roles, err)
+	}
+
+	policy := "path \"secret/data/mor/myproject/*\" {\n  capabilities = [ \"read\" ]\n}\n"
+	if err := lc.WritePolicy(ctx, "gitlab-project-42", policy); err != nil {
+		t.Fatalf("failed to write policy: %v", err)
+	}
+	err = lc.WriteJwtRole(ctx, "jwt", "gitlab-project-42", map[string]interface{}{
+		"role_type":         "jwt",
+		"user_claim":        "project_path",
+		"bound_audiences":   []string{"https://vault.example.com"},
+		"bound_claims_type": "string",
+		"bound_claims":      map[string]interface{}{"project_id": "42", "ref_protected": "true"},
+		"token_policies":    []string{"gitlab-project-42"},
+	})
+	if err != nil {
+		t.Fatalf("failed to write role: %v", err)
+	}
+
+	role, err := client.Logical().Read("auth/jwt/role/gitlab-project-42")
+	if err != nil {
+		t.Fatalf("failed to read role: %v", err)
+	}
+	claims, _ := role.Data["bound_claims"].(map[string]interface{})
+	if claims["project_id"] != "42" {
+		t.Fatalf("expected the role bound to project 42, got %v", role.Data["bound_claims"])
+	}
+	roles, err = lc.ListJwtRoles(ctx, "jwt")
+	if err != nil || len(roles) != 1 || roles[0] != "gitlab-project-42" {
+		t.Fatalf("expected the new role, got %v: %v", roles, err)
+	}
+
+	if err := lc.DeleteJwtRole(ctx, "jwt", "gitlab-project-42"); err != nil {
+		t.Fatalf("failed to delete role: %v", err)
+	}
+	if err := lc.DeletePolicy(ctx, "gitlab-project-42"); err != nil {
+		t.Fatalf("failed to delete policy: %v", err)
+	}
+	if p, _ := client.Sys().GetPolicy("gitlab-project-42"); p != "" {
+		t.Fatalf("expected the policy to be deleted, got %q", p)
+	}
+}
+
+func TestRetrieveCredsAgeFile(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("failed to generate an age identity: %v", err)
+	}
+	dir := t.TempDir()
+
+	// armored, as `age -a` writes it
+	var buf bytes.Buffer
+	aw := armor.NewWriter(&buf)
+	w, err := age.Encrypt(aw, identity.Recipient())
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	w.Write([]byte("token: glpat-lab\nuser: root\n"))
+	w.Close()
+	aw.Close()
+	file := filepath.Join(dir, "gitlab.yaml.age")
+	if err := os.WriteFile(file, buf.Bytes(), 0o600); err != nil {
+		t.Fatalf("failed to write the encrypted file: %v", err)
+	}
+
+	keyFile := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(keyFile, []byte("# lab key\n"+identity.String()+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write the key file: %v", err)
+	}
+	other, _ := age.GenerateX25519Identity()
+
+	t.Run("env", func(t *testing.T) {
+		t.Setenv("LAB_AGE_KEY", identity.String())
+		resp, err := GetSecret(NewCredsAgeFile(file, "LAB_AGE_KEY", ""), context.Background())
+		if err != nil {
+			t.Fatalf("failed to retrieve creds: %v", err)
+		}
+		if resp.Token["token"] != "glpat-lab" || resp.Token["user"] != "root" {
+			t.Fatalf("expected the decrypted token map, got: %v", resp.Token)
+		}
+		if resp.ExpireTime != "" {
+			t.Fatalf("expected no expire time, got %q", resp.ExpireTime)
+		}
+	})
+
+	t.Run("key file", func(t *testing.T) {
+		t.Setenv(DefaultAgeKeyEnv, "")
+		resp, err := NewCredsAgeFile(file, "", keyFile).RetrieveCreds(context.Background())
+		if err != nil {
+			t.Fatalf("failed to retrieve creds: %v", err)
+		}
+		if resp.Token["token"] != "glpat-lab" {
+			t.Fatalf("expected token to be 'glpat-lab', got: %v", resp.Token["token"])
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		t.Setenv("LAB_AGE_KEY", other.String())
+		if _, err := NewCredsAgeFile(file, "LAB_AGE_KEY", "").RetrieveCreds(context.Background()); err == nil {
+			t.Fatal("expected an error with another key")
+		}
+	})
+
+	t.Run("no key", func(t *testing.T) {
+		t.Setenv(DefaultAgeKeyEnv, "")
+		if _, err := NewCredsAgeFile(file, "", "").RetrieveCreds(context.Background()); err == nil {
+			t.Fatal("expected an error without key")
+		}
+	})
+}